@@ -0,0 +1,77 @@
+package callcache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNotInBatch is returned when the loader of WithBatchLoader returns no
+// result for a key that it has been asked for.
+var ErrNotInBatch = errors.New("callcache: not returned by the batch loader")
+
+// batchLoader coalesces the synchronous reloads of the expired keys into the
+// calls of the loader of WithBatchLoader.
+type batchLoader struct {
+	window time.Duration
+	load   func(keys []string) (map[string]interface{}, error)
+	// invoke calls the loader, on the serial executor if any.
+	invoke func(w work) (interface{}, error)
+
+	mu      sync.Mutex
+	pending *batch
+}
+
+// batch is the keys accumulated within a window and the results of them.
+type batch struct {
+	keys   []string
+	done   chan struct{}
+	values map[string]interface{}
+	err    error
+}
+
+// get adds key to the pending batch, starting a new one if there is none, and
+// waits for the loader to return the results of the batch.
+func (l *batchLoader) get(key string) (interface{}, error) {
+	l.mu.Lock()
+	b := l.pending
+	if b == nil {
+		b = &batch{done: make(chan struct{})}
+		l.pending = b
+		time.AfterFunc(l.window, func() { l.flush(b) })
+	}
+	b.keys = append(b.keys, key)
+	l.mu.Unlock()
+
+	<-b.done
+	if b.err != nil {
+		return nil, b.err
+	}
+	v, ok := b.values[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNotInBatch, key)
+	}
+	return v, nil
+}
+
+// flush closes b to new keys and calls the loader with the keys of it.
+func (l *batchLoader) flush(b *batch) {
+	l.mu.Lock()
+	if l.pending == b {
+		l.pending = nil
+	}
+	l.mu.Unlock()
+
+	v, err := l.invoke(work{fn: func() (v interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				v, err = nil, fmt.Errorf("%w: %v", ErrPanicked, r)
+			}
+		}()
+		return l.load(b.keys)
+	}})
+	b.values, _ = v.(map[string]interface{})
+	b.err = err
+	close(b.done)
+}
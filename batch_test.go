@@ -0,0 +1,146 @@
+package callcache_test
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithBatchLoader(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var mu sync.Mutex
+	var batches [][]string
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+		callcache.WithClock(clock),
+		callcache.WithBatchLoader(50*time.Millisecond, func(keys []string) (map[string]interface{}, error) {
+			mu.Lock()
+			batches = append(batches, append([]string(nil), keys...))
+			mu.Unlock()
+			values := make(map[string]interface{})
+			for _, key := range keys {
+				if key != "missing" {
+					values[key] = key + "-batched"
+				}
+			}
+			return values, nil
+		}),
+	)
+
+	keys := []string{"a", "b", "c", "missing"}
+	for _, key := range keys {
+		key := key
+		dispatcher.Do(key, func() (interface{}, error) { return key, nil })
+	}
+	clock.Add(2 * time.Minute)
+
+	var wg sync.WaitGroup
+	got := make([]interface{}, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		i, key := i, key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[i], errs[i] = dispatcher.Do(key, func() (interface{}, error) {
+				t.Errorf("fn of %q was called", key)
+				return nil, nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	if len(batches) != 1 {
+		t.Fatalf("loader was called %d times, want 1: %v", len(batches), batches)
+	}
+	sort.Strings(batches[0])
+	if want := []string{"a", "b", "c", "missing"}; !reflect.DeepEqual(batches[0], want) {
+		t.Errorf("loader got %v, want %v", batches[0], want)
+	}
+	for i, key := range keys[:3] {
+		if want := key + "-batched"; got[i] != want || errs[i] != nil {
+			t.Errorf("Do(%q) = %v, %v, want %v, nil", key, got[i], errs[i], want)
+		}
+	}
+	if !errors.Is(errs[3], callcache.ErrNotInBatch) {
+		t.Errorf("Do(missing) error = %v, want %v", errs[3], callcache.ErrNotInBatch)
+	}
+}
+
+func TestWithBatchLoader_serial(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var batches int32
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+		callcache.WithClock(clock),
+		callcache.WithSerialExecutor(),
+		callcache.WithBatchLoader(50*time.Millisecond, func(keys []string) (map[string]interface{}, error) {
+			atomic.AddInt32(&batches, 1)
+			values := make(map[string]interface{})
+			for _, key := range keys {
+				values[key] = key + "-batched"
+			}
+			return values, nil
+		}),
+	)
+	defer dispatcher.Close()
+
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		key := key
+		dispatcher.Do(key, func() (interface{}, error) { return key, nil })
+	}
+	clock.Add(2 * time.Minute)
+
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		key := key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := dispatcher.Do(key, nil); v != key+"-batched" || err != nil {
+				t.Errorf("Do(%q) = %v, %v, want %v, nil", key, v, err, key+"-batched")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The waits for the batch do not occupy the serial executor one by one.
+	if n := atomic.LoadInt32(&batches); n != 1 {
+		t.Errorf("loader was called %d times, want 1", n)
+	}
+}
+
+func TestWithBatchLoader_error(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	errLoad := errors.New("load")
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+		callcache.WithClock(clock),
+		callcache.WithBatchLoader(time.Millisecond, func(keys []string) (map[string]interface{}, error) {
+			return nil, errLoad
+		}),
+	)
+
+	calls := 0
+	fn := func() (interface{}, error) {
+		calls++
+		return "v", nil
+	}
+	if _, err := dispatcher.Do("key", fn); err != nil {
+		t.Fatalf("first Do() error = %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("fn was called %d times by the first load, want 1", calls)
+	}
+	clock.Add(2 * time.Minute)
+	if _, err := dispatcher.Do("key", fn); err != errLoad {
+		t.Errorf("Do() error = %v, want %v", err, errLoad)
+	}
+	if calls != 1 {
+		t.Errorf("fn was called %d times, want 1", calls)
+	}
+}
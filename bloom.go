@@ -0,0 +1,89 @@
+package callcache
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// bloomFilter is a bloom filter of the keys for WithBloomFilter, whose bits are
+// accessed atomically so that it can be read without any lock.
+type bloomFilter struct {
+	bits []uint64
+	k    uint64
+}
+
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	words := int(math.Ceil(m / 64))
+	if words < 1 {
+		words = 1
+	}
+	k := uint64(math.Round(float64(words*64) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, words), k: k}
+}
+
+// positions calls fn with each bit position of key by double hashing.
+func (f *bloomFilter) positions(key string, fn func(i uint64) bool) {
+	h1 := fnv64a(key)
+	h2 := ringHash(key) | 1
+	m := uint64(len(f.bits) * 64)
+	for i := uint64(0); i < f.k; i++ {
+		if !fn((h1 + i*h2) % m) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(key string) {
+	f.positions(key, func(i uint64) bool {
+		addr, mask := &f.bits[i/64], uint64(1)<<(i%64)
+		for {
+			old := atomic.LoadUint64(addr)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(addr, old, old|mask) {
+				return true
+			}
+		}
+	})
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	ok := true
+	f.positions(key, func(i uint64) bool {
+		ok = atomic.LoadUint64(&f.bits[i/64])&(uint64(1)<<(i%64)) != 0
+		return ok
+	})
+	return ok
+}
+
+func (f *bloomFilter) reset() {
+	for i := range f.bits {
+		atomic.StoreUint64(&f.bits[i], 0)
+	}
+}
+
+// MayContain reports whether the given key may have an execution result. With
+// WithBloomFilter, it is answered by the filter without looking up the key, so
+// false means that the key definitely has no result, while true may be a false
+// positive. The keys stay in the filter after they are removed until Clear is
+// called. Without WithBloomFilter, it looks up the key and is exact.
+func (d *Dispatcher) MayContain(key string) bool {
+	if d.checkKey(key) != nil {
+		return false
+	}
+	if d.bloom != nil {
+		return d.bloom.mayContain(d.hashKey(key))
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.loaded
+}
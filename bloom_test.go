@@ -0,0 +1,54 @@
+package callcache_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithBloomFilter(t *testing.T) {
+	const n = 1000
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithBloomFilter(n, 0.01))
+
+	for i := 0; i < n; i++ {
+		key := strconv.Itoa(i)
+		if i%2 == 0 {
+			dispatcher.Set(key, i)
+		} else {
+			dispatcher.Do(key, func() (interface{}, error) { return i, nil })
+		}
+	}
+	for i := 0; i < n; i++ {
+		if !dispatcher.MayContain(strconv.Itoa(i)) {
+			t.Fatalf("MayContain(%d) = false, want true", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := n; i < 11*n; i++ {
+		if dispatcher.MayContain(strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / (10 * n); rate > 0.03 {
+		t.Errorf("false positive rate = %v, want at most 0.03", rate)
+	}
+
+	dispatcher.Clear()
+	if dispatcher.MayContain("0") {
+		t.Error("MayContain() after Clear() = true, want false")
+	}
+}
+
+func TestDispatcher_MayContain(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	dispatcher.Set("key", "value")
+	if !dispatcher.MayContain("key") {
+		t.Error("MayContain(key) = false, want true")
+	}
+	if dispatcher.MayContain("missing") {
+		t.Error("MayContain(missing) = true, want false")
+	}
+}
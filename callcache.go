@@ -2,7 +2,17 @@
 package callcache
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/singleflight"
@@ -10,84 +20,1445 @@ import (
 
 // Dispatcher handles each call.
 type Dispatcher struct {
-	mu             sync.Mutex
-	expiration     int64
-	updateInterval int64
-	calls          map[string]*call
+	// The structs of int64 fields are first for their alignment.
+	stats       stats
+	cardinality cardinality
+
+	expiration     int64 // accessed atomically
+	updateInterval int64 // accessed atomically
+	entries        int64 // accessed atomically
+	grown          int64 // accessed atomically
+	generation     int64 // accessed atomically
+	closed         int32 // accessed atomically
+	shards         []*shard
+	shardHasher    func(key string) uint64
+	shared         singleflight.Group
+	snapshotMu     sync.Mutex
+	tags           tagIndex
+
+	breakerFailures    int
+	breakerCooldown    int64
+	quarantineFailures int
+	quarantineInterval int64
+	validator          func(key string, v interface{}) error
+	keyHasher          func(key string) string
+	idleTimeout        int64
+	reaperConcurrency  int
+	expiredInterval    time.Duration
+	transforms         []func(v interface{}) interface{}
+	memory             *memoryPressure
+	batch              *batchLoader
+	propagate          bool
+	refreshDone        func(key string)
+	weakValues         bool
+	errorValue         ErrorValuePolicy
+	debugStacks        bool
+	parallelRefresh    func(key string) bool
+	refreshGate        func(key string) sync.Locker
+	adaptiveMin        int64
+	adaptiveMax        int64
+	adaptiveEqual      func(a, b interface{}) bool
+	onFirstLoad        func(key string, v interface{})
+	maxEntries         int
+	evictionPolicy     EvictionPolicy
+	evictor            evictor
+	discardOnCancel    bool
+	leaderHandoff      bool
+	contextKey         func(ctx context.Context) string
+	allowStale         bool
+	readOnly           bool
+	growthObserver     func(newSize int)
+	leaser             Leaser
+	leaseTTL           int64
+	removeAfter        int
+	maxServeAge        int64
+	freezeCheck        func(key string)
+	consistencyCheck   func(key string, leader, follower interface{})
+	emptyKey           emptyKeyMode
+	events             *eventBatcher
+	eventsInterval     time.Duration
+	errorHistory       int
+	loads              chan struct{}
+	loadsFailFast      bool
+	valuePool          *valuePool
+	serial             chan serialJob
+	cardinalityRate    float64
+	cardinalityFn      func(ratePerSec float64)
+	tombstoneGrace     int64
+	keyValidator       func(key string) error
+	minRefreshInterval int64
+	startupJitter      int64
+	historySize        int
+	scheduler          *scheduler
+	maxTotalAge        int64
+	bloom              *bloomFilter
+	overflow           Store
+	groupLimit         int
+	groupContinue      bool
+	onEvict            func(key string, v interface{}, reason EvictReason)
+	stampede           int
+	stampedeFn         func(key string, concurrent int)
+
+	clock Clock
+	epoch time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewDispatcher creates a new Dispatcher of function or method calls.
 // expiration is the period to keep the execution result. If updateInterval is
 // greater than 0, the cache of the execution result will be updated in the
 // background when the elapsed time from the previous execution is exceeded.
-func NewDispatcher(expiration, updateInterval time.Duration) *Dispatcher {
-	return &Dispatcher{
-		expiration:     expiration.Nanoseconds(),
-		updateInterval: updateInterval.Nanoseconds(),
-		calls:          make(map[string]*call),
+func NewDispatcher(expiration, updateInterval time.Duration, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		expiration:        expiration.Nanoseconds(),
+		updateInterval:    updateInterval.Nanoseconds(),
+		shards:            newShards(),
+		shardHasher:       fnv64a,
+		reaperConcurrency: 1,
+		clock:             systemClock{},
+		done:              make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.adaptiveEqual != nil {
+		d.expiration = d.adaptiveMin
+	}
+	d.epoch = d.clock.Now()
+	if d.maxEntries > 0 {
+		d.evictor = newEvictor(d.evictionPolicy, d.maxEntries)
+	} else if d.memory != nil {
+		// Track the usage of the keys only to choose the ones to evict.
+		d.evictor = newEvictor(d.evictionPolicy, math.MaxInt)
+	}
+	if d.idleTimeout > 0 {
+		go d.reap(reapInterval(time.Duration(d.idleTimeout)), d.removeIdle)
+	}
+	if d.memory != nil {
+		go d.watchMemory()
+	}
+	if d.expiredInterval > 0 {
+		go d.reap(d.expiredInterval, func() { d.RemoveExpired() })
+	}
+	if d.events != nil && d.eventsInterval > 0 {
+		go d.flushEvents(d.eventsInterval)
 	}
+	if d.serial != nil {
+		go d.runSerial()
+	}
+	return d
+}
+
+// SetExpiration changes the expiration of the keys created after that. With
+// WithSettingsPropagation, the existing keys are also changed.
+func (d *Dispatcher) SetExpiration(expiration time.Duration) {
+	d.setTiming(&d.expiration, expiration, func(c *call) *int64 { return &c.expiration })
+}
+
+// SetUpdateInterval changes the updateInterval of the keys created after that.
+// With WithSettingsPropagation, the existing keys are also changed.
+func (d *Dispatcher) SetUpdateInterval(updateInterval time.Duration) {
+	d.setTiming(&d.updateInterval, updateInterval, func(c *call) *int64 { return &c.updateInterval })
+}
+
+func (d *Dispatcher) setTiming(addr *int64, v time.Duration, field func(c *call) *int64) {
+	atomic.StoreInt64(addr, v.Nanoseconds())
+	if d.propagate {
+		d.rangeCalls(func(_ string, c *call) {
+			atomic.StoreInt64(field(c), v.Nanoseconds())
+		})
+	}
+}
+
+// Close stops the background goroutines of the Dispatcher, after which Do and
+// its variants return ErrClosed. The execution results are kept as they are,
+// such as for Peek and Snapshot. With WithBatchedEvents, the buffered events
+// are delivered before it returns.
+func (d *Dispatcher) Close() {
+	d.closeOnce.Do(func() {
+		atomic.StoreInt32(&d.closed, 1)
+		close(d.done)
+		if d.events != nil {
+			d.events.flush()
+		}
+	})
 }
 
 // Do returns the execution result of fn associated with the given key. If there
 // is a valid execution result, it is reused instead of the return value of fn.
+// If fn returns an error, its value is returned along with the error unless
+// WithStaleOnError is given.
+//
+// A cache hit does not allocate by itself. However, since fn may be executed in
+// the background after Do returns, a closure capturing variables is allocated
+// on the heap by the caller at each call, even for a hit. In a hot path, fn
+// should be created once and reused, or not capture anything.
 func (d *Dispatcher) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
-	d.mu.Lock()
-	if d.calls[key] == nil {
-		d.calls[key] = &call{expiration: d.expiration, updateInterval: d.updateInterval}
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	return d.call(key).do(work{fn: fn})
+}
+
+// DoWithSeed is like Do, but seed is used as the execution result if there
+// has never been one for the given key, so fn is executed for the first time
+// when the seed is updated or expires.
+func (d *Dispatcher) DoWithSeed(key string, seed interface{}, fn func() (interface{}, error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	c := d.call(key)
+	var first bool
+	c.mu.Lock()
+	if c.lastUpdate.IsZero() {
+		seed = d.transform(seed)
+		first = c.store(seed, d.clock.Now())
+	}
+	c.mu.Unlock()
+	if first {
+		c.firstLoaded(seed)
+	}
+	return c.do(work{fn: fn})
+}
+
+// DoOrDefault is like Do, but never waits for fn. If there is no valid
+// execution result, fn is executed in the background and def is returned. def
+// is also returned if fn returns an error, or without executing fn if the
+// Dispatcher is closed.
+func (d *Dispatcher) DoOrDefault(key string, def interface{}, fn func() (interface{}, error)) interface{} {
+	if d.checkCall(key) != nil {
+		return def
+	}
+	c := d.call(key)
+	w := work{fn: fn}
+	v, _, expired := c.load(w)
+	if expired {
+		c.refresh(w)
+		return def
+	}
+	return v
+}
+
+// DoShared is like Do, but the executions of fn are shared among all callers
+// with the same sfKey, even if their keys are different. The shared result is
+// cached under each key.
+func (d *Dispatcher) DoShared(key, sfKey string, fn func() (interface{}, error)) (interface{}, error) {
+	return d.Do(key, func() (interface{}, error) {
+		v, err, _ := d.shared.Do(sfKey, fn)
+		return v, err
+	})
+}
+
+// ErrUnexpectedType is returned by DoReader when the result of the key is not
+// what it caches, such as the one set by Set with another type.
+var ErrUnexpectedType = errors.New("callcache: unexpected type of result")
+
+// DoReader is like Do, but caches the content read from the io.Reader returned
+// by fn. Each caller gets a new io.Reader of the cached content, so that the
+// concurrent callers can read it independently. If the key has a result other
+// than []byte, it returns an error wrapping ErrUnexpectedType.
+func (d *Dispatcher) DoReader(key string, fn func() (io.Reader, error)) (io.Reader, error) {
+	v, err := d.Do(key, func() (interface{}, error) {
+		r, err := fn()
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w %T for %q", ErrUnexpectedType, v, key)
+	}
+	return bytes.NewReader(b), nil
+}
+
+// DoContext is like Do, but fn receives ctx of the caller that executes it. When
+// fn is executed in the background, it receives a context that is detached from
+// the cancellation and deadline of ctx but still carries the values of ctx.
+// A caller waiting for fn executed by another caller gives up when its ctx is
+// done, and gets the previous result if any along with the error of ctx.
+// With WithContextKeyExtractor, the key is combined with the component
+// extracted from ctx.
+func (d *Dispatcher) DoContext(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	if d.contextKey != nil {
+		key = key + "\x00" + d.contextKey(ctx)
+	}
+	return d.call(key).do(work{ctx: ctx, ctxFn: fn})
+}
+
+// DoUntil is like Do, but the execution result of fn is valid until validUntil,
+// such as the time given by an Expires header, instead of the expiration.
+func (d *Dispatcher) DoUntil(key string, validUntil time.Time, fn func() (interface{}, error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	return d.call(key).do(work{fn: fn, validUntil: validUntil})
+}
+
+// DoWithTimestamp is like Do, but also returns when the returned execution
+// result was stored, which can be used as its Last-Modified time. If the
+// result was not stored, such as when fn returns an error, it is the current
+// time.
+func (d *Dispatcher) DoWithTimestamp(key string, fn func() (interface{}, error)) (interface{}, time.Time, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, time.Time{}, err
+	}
+	c := d.call(key)
+	v, err := c.do(work{fn: fn})
+	if err != nil && err != ErrStale {
+		return v, d.clock.Now(), err
+	}
+
+	// The result may have been updated in the background after c.do, so the
+	// current one is returned to match the timestamp.
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if cur, ok := c.value(); ok {
+		return cur, c.lastUpdate, err
+	}
+	return v, d.clock.Now(), err
+}
+
+// DoReplace is like Do, but the executions of fn that start before switchAt
+// call oldFn and the ones that start at or after it call newFn, so that the
+// source of the key can be switched at the scheduled time. The result of
+// oldFn is still returned until it is updated by newFn, in the same way as
+// any other result.
+func (d *Dispatcher) DoReplace(key string, switchAt time.Time, oldFn, newFn func() (interface{}, error)) (interface{}, error) {
+	return d.Do(key, func() (interface{}, error) {
+		if d.clock.Now().Before(switchAt) {
+			return oldFn()
+		}
+		return newFn()
+	})
+}
+
+// DoWithTimeout is like Do, but fn of the given key times out after timeout, in
+// which case ErrTimeout is returned and the result of fn is discarded when it
+// returns. The timeout is set by the first call of DoWithTimeout for the key
+// and applies to all the executions of fn for it, including the ones in the
+// background.
+func (d *Dispatcher) DoWithTimeout(key string, timeout time.Duration, fn func() (interface{}, error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	c := d.call(key)
+	atomic.CompareAndSwapInt64(&c.timeout, 0, timeout.Nanoseconds())
+	return c.do(work{fn: fn})
+}
+
+// ErrFallback is returned by DoWithContextTimeout along with the previous
+// execution result when a fresh one is not ready in time.
+var ErrFallback = errors.New("callcache: timed out, serving the previous result")
+
+// DoWithContextTimeout is like DoContext, but waits for a fresh execution
+// result up to timeout or until ctx is done, whichever comes first. After that
+// it returns the previous result if any along with ErrFallback, or else nil
+// along with the error of ctx or ErrTimeout. In either case, fn keeps running
+// with a context detached from ctx, and its result is cached for the later
+// calls.
+func (d *Dispatcher) DoWithContextTimeout(ctx context.Context, key string, timeout time.Duration, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	if d.contextKey != nil {
+		key = key + "\x00" + d.contextKey(ctx)
+	}
+	c := d.call(key)
+	w := work{ctx: detachedContext{ctx}, ctxFn: fn}
+	v, age, expired := c.load(w)
+	if !expired {
+		if d.maxServeAge > 0 && age > d.maxServeAge {
+			return v, ErrStale
+		}
+		return v, nil
+	}
+
+	ch := make(chan outcome, 1)
+	go func() {
+		v, err := c.update(w)
+		ch <- outcome{v: v, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = ErrTimeout
+	}
+
+	c.mu.RLock()
+	prev, ok := c.value()
+	c.mu.RUnlock()
+	if ok {
+		return prev, ErrFallback
+	}
+	return nil, err
+}
+
+// DoStream is like Do, but onValue is called with the execution result of the
+// given key, and then with each result of the subsequent executions of fn for
+// it, including the ones in the background triggered by other calls. onValue
+// is called outside any lock until the key is removed, and it may be called
+// concurrently if the executions overlap. If there is no valid result and fn
+// returns an error, the error is returned and onValue is not registered.
+func (d *Dispatcher) DoStream(key string, fn func() (interface{}, error), onValue func(interface{})) error {
+	if err := d.checkCall(key); err != nil {
+		return err
+	}
+	c := d.call(key)
+	if _, err := c.do(work{fn: fn}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.streams = append(c.streams, onValue)
+	v, ok := c.value()
+	c.mu.Unlock()
+	if ok {
+		onValue(v)
+	}
+	return nil
+}
+
+// Result holds the results of Do.
+type Result struct {
+	Val interface{}
+	Err error
+}
+
+// DoBatch calls Do for each of the given keys concurrently and returns the
+// results keyed by them. Duplicate keys are called only once, and fn receives
+// the key being executed.
+func (d *Dispatcher) DoBatch(keys []string, fn func(key string) (interface{}, error)) map[string]Result {
+	distinct := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		distinct[key] = struct{}{}
+	}
+
+	results := make(map[string]Result, len(distinct))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for key := range distinct {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			v, err := d.Do(key, func() (interface{}, error) {
+				return fn(key)
+			})
+			mu.Lock()
+			results[key] = Result{Val: v, Err: err}
+			mu.Unlock()
+		}(key)
+	}
+	wg.Wait()
+	return results
+}
+
+// call returns the call associated with the given key, creating it if needed.
+// The key stored in the map is a copy of the given key, so the map doubles as
+// an interning table and does not retain the caller's backing array.
+func (d *Dispatcher) call(key string) *call {
+	return d.hashedCall(d.hashKey(key))
+}
+
+// hashedCall is like call, but the key has already been replaced by
+// WithKeyHasher.
+func (d *Dispatcher) hashedCall(key string) *call {
+	return d.loadOrCreate(key, false)
+}
+
+// loadOrCreate is like hashedCall, but the call is created pinned by Pin if
+// pinned is true, so that it is never admitted to the evictor.
+func (d *Dispatcher) loadOrCreate(key string, pinned bool) *call {
+	s := d.shard(key)
+
+	s.mu.RLock()
+	c := s.calls[key]
+	s.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+
+	s.mu.Lock()
+	if c = s.calls[key]; c != nil {
+		s.mu.Unlock()
+		return c
+	}
+	key = strings.Clone(key)
+	c = &call{
+		d:              d,
+		key:            key,
+		expiration:     atomic.LoadInt64(&d.expiration),
+		updateInterval: atomic.LoadInt64(&d.updateInterval),
+		parallel:       d.parallelRefresh != nil && d.parallelRefresh(key),
+	}
+	if pinned {
+		c.pinned = 1
+	}
+	if d.startupJitter > 0 {
+		c.startupDelay = rand.Int63n(d.startupJitter)
+	}
+	// A new key is not idle even before it is loaded, such as by Set.
+	c.accessed(d.clock.Now())
+	s.calls[key] = c
+	s.mu.Unlock()
+
+	if n := atomic.AddInt64(&d.entries, 1); d.growthObserver != nil && n&(n-1) == 0 {
+		d.observeGrowth(n)
+	}
+	if d.cardinalityFn != nil {
+		d.checkCardinality()
+	}
+	if d.evictor != nil && !pinned {
+		d.admit(c)
+	}
+	return c
+}
+
+// observeGrowth calls the function set by WithMapGrowthObserver unless n,
+// which is a power of two, has been reported before, since maps never shrink.
+func (d *Dispatcher) observeGrowth(n int64) {
+	bit := int64(1) << (bits.Len64(uint64(n)) - 1)
+	for {
+		reported := atomic.LoadInt64(&d.grown)
+		if reported&bit != 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&d.grown, reported, reported|bit) {
+			d.growthObserver(int(n))
+			return
+		}
+	}
+}
+
+// lookup returns the call associated with the given key, or nil if there is
+// none.
+func (d *Dispatcher) lookup(key string) *call {
+	key = d.hashKey(key)
+	s := d.shard(key)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.calls[key]
+}
+
+// ErrEmptyKey is returned for the empty key with WithRejectEmptyKey.
+var ErrEmptyKey = errors.New("callcache: empty key")
+
+// ErrInvalidKey is returned for the keys rejected by WithKeyValidator. It is
+// wrapped with the error returned by the validator.
+var ErrInvalidKey = errors.New("callcache: invalid key")
+
+// checkCall returns ErrClosed if the Dispatcher is closed, which is checked
+// before the key is looked up so that a closed Dispatcher is left untouched,
+// or the error of checkKey.
+func (d *Dispatcher) checkCall(key string) error {
+	if atomic.LoadInt32(&d.closed) != 0 {
+		return ErrClosed
+	}
+	return d.checkKey(key)
+}
+
+// checkKey returns ErrEmptyKey, or panics with it, or ErrInvalidKey if the key
+// is rejected. The methods without an error result treat a rejected key as if
+// it did not exist.
+func (d *Dispatcher) checkKey(key string) error {
+	if key == "" && d.emptyKey != emptyKeyAllow {
+		if d.emptyKey == emptyKeyPanic {
+			panic(ErrEmptyKey)
+		}
+		return ErrEmptyKey
+	}
+	if d.keyValidator != nil {
+		if err := d.keyValidator(key); err != nil {
+			return fmt.Errorf("%w %q: %v", ErrInvalidKey, key, err)
+		}
+	}
+	return nil
+}
+
+// hashKey returns the key replaced by the key hasher if any.
+func (d *Dispatcher) hashKey(key string) string {
+	if d.keyHasher == nil {
+		return key
 	}
-	d.mu.Unlock()
+	return d.keyHasher(key)
+}
 
-	return d.calls[key].do(fn)
+// transform applies the functions added by WithTransform to v.
+func (d *Dispatcher) transform(v interface{}) interface{} {
+	for _, fn := range d.transforms {
+		v = fn(v)
+	}
+	return v
+}
+
+// Set sets v as the execution result of the given key, as if fn had returned
+// it just now.
+func (d *Dispatcher) Set(key string, v interface{}) {
+	if d.checkKey(key) != nil {
+		return
+	}
+	c := d.call(key)
+	now := d.clock.Now()
+	c.accessed(now)
+	v = d.transform(v)
+	c.mu.Lock()
+	first := c.store(v, now)
+	c.mu.Unlock()
+	if first {
+		c.firstLoaded(v)
+	}
 }
 
 // Remove removes the execution result of the given key.
 func (d *Dispatcher) Remove(key string) {
-	d.mu.Lock()
-	delete(d.calls, key)
-	d.mu.Unlock()
+	if d.checkKey(key) != nil {
+		return
+	}
+	if c := d.remove(key); c != nil {
+		d.removed(EvictRemoved, c)
+	}
+}
+
+// Expire makes the execution result of the given key expire without removing
+// it, so that the next call executes fn, while the previous result is still
+// available to WithAllowStale and WithStaleOnError.
+func (d *Dispatcher) Expire(key string) {
+	if d.checkKey(key) != nil {
+		return
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if !c.lastUpdate.IsZero() {
+		// Pin the expiration before the last update, as DoUntil does.
+		c.validUntil = c.lastUpdate.Add(-1)
+	}
+	c.mu.Unlock()
+}
+
+// Bump makes all the execution results expire without removing them, like
+// Expire for every key. It takes constant time regardless of the number of
+// keys, since each result is checked against the generation that Bump
+// advances when it is read.
+func (d *Dispatcher) Bump() {
+	atomic.AddInt64(&d.generation, 1)
+}
+
+// remove removes the call associated with the given key and returns it, or nil
+// if there is none. With WithRemoveTombstone, the key is tombstoned even if
+// there is no call, since a call may be created concurrently.
+func (d *Dispatcher) remove(key string) *call {
+	key = d.hashKey(key)
+	s := d.shard(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.calls[key]
+	delete(s.calls, key)
+	if d.tombstoneGrace > 0 {
+		d.tombstone(s, key, d.clock.Now())
+	}
+	return c
+}
+
+// Take removes the execution result of the given key and returns it. The
+// boolean is false if there is no valid execution result. Only one of the
+// concurrent calls of Take for the same key gets the result, and fn is never
+// called. If an update is in flight, Take returns the result before the update
+// and the updated result is discarded.
+func (d *Dispatcher) Take(key string) (interface{}, bool) {
+	if d.checkKey(key) != nil {
+		return nil, false
+	}
+	c := d.remove(key)
+	if c == nil {
+		return nil, false
+	}
+	d.removed(EvictRemoved, c)
+
+	now := d.clock.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.age(now) > c.ttl() {
+		return nil, false
+	}
+	return c.value()
+}
+
+// Peek returns the execution result of the given key without calling fn or
+// affecting the eviction. The boolean is false if there is no valid execution
+// result.
+func (d *Dispatcher) Peek(key string) (interface{}, bool) {
+	if d.checkKey(key) != nil {
+		return nil, false
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return nil, false
+	}
+	return c.peek(d.clock.Now())
+}
+
+// peek returns the result of c if it is valid at now.
+func (c *call) peek(now time.Time) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.age(now) > c.ttl() {
+		return nil, false
+	}
+	return c.value()
+}
+
+// ErrNotCached is returned by DoCached when there is no valid execution result,
+// and by Do and the like with WithReadOnly when there is no result.
+var ErrNotCached = errors.New("callcache: not cached")
+
+// DoCached is like Peek, but returns ErrNotCached if there is no valid
+// execution result. It never executes fn, so that the callers only read the
+// results stored by others, such as a warmer calling Set or Do.
+func (d *Dispatcher) DoCached(key string) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	if c := d.lookup(key); c != nil {
+		if v, ok := c.peek(d.clock.Now()); ok {
+			return v, nil
+		}
+	}
+	return nil, ErrNotCached
+}
+
+// Keys returns the keys in the Dispatcher in no particular order.
+func (d *Dispatcher) Keys() []string {
+	var keys []string
+	d.rangeCalls(func(key string, _ *call) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// Len returns the number of keys in the Dispatcher.
+func (d *Dispatcher) Len() int {
+	return int(atomic.LoadInt64(&d.entries))
+}
+
+// LenFresh returns the number of keys whose execution results have not
+// expired, while Len also counts the ones retained after the expiration, such
+// as those served by WithAllowStale or waiting to be removed. Unlike Len, it
+// checks every key.
+func (d *Dispatcher) LenFresh() int {
+	now := d.clock.Now()
+	n := 0
+	d.rangeCalls(func(_ string, c *call) {
+		c.mu.RLock()
+		if c.age(now) <= c.ttl() {
+			n++
+		}
+		c.mu.RUnlock()
+	})
+	return n
+}
+
+// Waiters returns the number of the goroutines waiting for the execution of fn
+// for the given key, including the one executing it.
+func (d *Dispatcher) Waiters(key string) int {
+	if d.checkKey(key) != nil {
+		return 0
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&c.waiters))
+}
+
+// RefreshPending reports whether the next call for the given key would update
+// its execution result in the background, that is, whether the result is
+// older than updateInterval but has not expired. It does not trigger anything.
+func (d *Dispatcher) RefreshPending(key string) bool {
+	if d.checkKey(key) != nil {
+		return false
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return false
+	}
+	_, updateInterval := c.timing()
+	if updateInterval <= 0 {
+		return false
+	}
+
+	now := d.clock.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	t := c.age(now)
+	return updateInterval+atomic.LoadInt64(&c.startupDelay) < t && t <= c.ttl()
+}
+
+// KeyConfig is the configuration in effect for a key.
+type KeyConfig struct {
+	Expiration      time.Duration
+	UpdateInterval  time.Duration
+	ParallelRefresh bool
+	// StartupDelay is the delay of WithStartupJitter added to UpdateInterval
+	// before the first refresh, which is zero after the key has been updated
+	// again.
+	StartupDelay time.Duration
+}
+
+// Config returns the KeyConfig of the given key. The boolean is false if there
+// is no such key.
+func (d *Dispatcher) Config(key string) (KeyConfig, bool) {
+	if d.checkKey(key) != nil {
+		return KeyConfig{}, false
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return KeyConfig{}, false
+	}
+
+	expiration, updateInterval := c.timing()
+	return KeyConfig{
+		Expiration:      time.Duration(expiration),
+		UpdateInterval:  time.Duration(updateInterval),
+		ParallelRefresh: c.parallel,
+		StartupDelay:    time.Duration(atomic.LoadInt64(&c.startupDelay)),
+	}, true
+}
+
+// HealthStatus is a snapshot of the freshness of the cached results.
+type HealthStatus struct {
+	// Entries is the number of keys that have a cached result.
+	Entries int
+	// OldestAge is the elapsed time since the least recent successful update.
+	OldestAge time.Duration
+	// Expired is the number of entries whose last successful update is older
+	// than the expiration, which means that their refreshes keep failing.
+	Expired int
+	// LastError is the most recent error among the entries whose latest
+	// update failed, and LastErrorAt is when it happened.
+	LastError   error
+	LastErrorAt time.Time
+}
+
+// Health returns the HealthStatus of the cached results. It only reads the
+// current state and never calls any function.
+func (d *Dispatcher) Health() HealthStatus {
+	now := d.clock.Now()
+
+	var h HealthStatus
+	d.rangeCalls(func(_ string, c *call) {
+		c.mu.RLock()
+		if c.err != nil && c.errorAt.After(h.LastErrorAt) {
+			h.LastError = c.err
+			h.LastErrorAt = c.errorAt
+		}
+		if !c.lastUpdate.IsZero() {
+			h.Entries++
+			if t := now.Sub(c.lastUpdate); t > h.OldestAge {
+				h.OldestAge = t
+			}
+			if c.age(now) > c.ttl() {
+				h.Expired++
+			}
+		}
+		c.mu.RUnlock()
+	})
+	return h
 }
 
 type call struct {
+	// The counters of PerKeyStats are first for their alignment.
+	stats          stats
+	waiters        int64 // accessed atomically
+	timeout        int64 // accessed atomically
+	lastAccess     int64 // accessed atomically
+	expiration     int64 // accessed atomically
+	updateInterval int64 // accessed atomically
+	startupDelay   int64 // accessed atomically
+	refreshing     int32 // accessed atomically
+	pinned         int32 // accessed atomically
 	mu             sync.RWMutex
-	expiration     int64
-	updateInterval int64
+	d              *Dispatcher
+	key            string
 	group          singleflight.Group
 	result         interface{}
-	lastUpdate     int64
+	lastUpdate     time.Time
+	validUntil     time.Time
+	createdAt      time.Time
+	token          string
+	err            error
+	errorAt        time.Time
+	failures       int
+	parallel       bool
+	loaded         bool
+	entry          evictionEntry
+	streams        []func(interface{})
+	fingerprint    uint64
+	errors         *ring[ErrorRecord]
+	history        *ring[HistoryEntry]
+	generation     int64
+	debug          *DebugInfo
+	flight         *flight
+}
+
+// ErrStale is returned along with the cached result if it is older than the
+// max serve age given by WithMaxServeAge.
+var ErrStale = errors.New("callcache: result is older than the max serve age")
+
+func (c *call) do(w work) (interface{}, error) {
+	v, age, expired := c.load(w)
+	if expired {
+		return c.update(w)
+	}
+	if c.d.maxServeAge > 0 && age > c.d.maxServeAge {
+		return v, ErrStale
+	}
+	return v, nil
+}
+
+// accessed records now as the last access to c for WithIdleTimeout.
+func (c *call) accessed(now time.Time) {
+	if c.d.idleTimeout > 0 {
+		atomic.StoreInt64(&c.lastAccess, c.d.sinceEpoch(now))
+	}
 }
 
-func (c *call) do(fn func() (interface{}, error)) (interface{}, error) {
-	now := time.Now().UnixNano()
+// load returns the result, its age and whether it has expired. If the result
+// is valid but the updateInterval has elapsed, or it has expired but
+// WithAllowStale is given, it is updated in the background.
+func (c *call) load(w work) (interface{}, int64, bool) {
+	now := w.now(c.d.clock)
+	c.accessed(now)
 
 	c.mu.RLock()
-	v := c.result
-	t := now - c.lastUpdate
+	v, ok := c.value()
+	t := c.age(now)
+	expiration := c.ttl()
+	if ok && c.d.freezeCheck != nil {
+		c.checkFrozen(v)
+	}
 	c.mu.RUnlock()
 
-	if t > c.expiration {
-		return c.update(fn)
+	_, updateInterval := c.timing()
+	if !ok || (t > expiration && !c.d.readOnly && (!c.d.allowStale || c.overAge(now))) {
+		atomic.AddInt64(&c.d.stats.misses, 1)
+		atomic.AddInt64(&c.stats.misses, 1)
+		return nil, t, true
 	}
-	if c.updateInterval > 0 && t > c.updateInterval {
-		go c.update(fn)
+	atomic.AddInt64(&c.d.stats.hits, 1)
+	atomic.AddInt64(&c.stats.hits, 1)
+	if c.d.evictor != nil {
+		c.d.evictor.touch(c)
 	}
-	return v, nil
+	if t > expiration || (updateInterval > 0 && t > updateInterval+atomic.LoadInt64(&c.startupDelay)) {
+		c.refresh(w)
+	}
+	return v, t, false
+}
+
+// age returns the elapsed nanoseconds since the last update at now. If there
+// has never been an update, or the last update is after now because the clock
+// went backwards, it returns math.MaxInt64 so that the result is treated as
+// expired rather than valid indefinitely. c.mu must be held.
+func (c *call) age(now time.Time) int64 {
+	if c.lastUpdate.IsZero() || now.Before(c.lastUpdate) {
+		return math.MaxInt64
+	}
+	return int64(now.Sub(c.lastUpdate))
 }
 
-func (c *call) update(fn func() (interface{}, error)) (interface{}, error) {
-	val, err, _ := c.group.Do("update", func() (interface{}, error) {
-		now := time.Now().UnixNano()
-		if t := now - c.lastUpdate; t < c.expiration && (c.updateInterval == 0 || t < c.updateInterval) {
-			// If the short term timing of c.group.Do does not match, use the previous result.
-			return c.result, nil
+// store sets v as the result updated at now and reports whether it is the
+// first result of c. c.mu must be held.
+func (c *call) store(v interface{}, now time.Time) bool {
+	first := !c.loaded
+	c.loaded = true
+	if first && c.d.bloom != nil {
+		c.d.bloom.add(c.key)
+	}
+	old := c.result
+	c.result = v
+	if c.d.weakValues {
+		c.result = makeWeak(v)
+	}
+	if p := c.d.valuePool; p != nil {
+		c.result = p.hold(v)
+		if old != nil {
+			p.recycle(old)
 		}
-		v, err := fn()
-		if err == nil {
-			c.mu.Lock()
-			c.result = v
-			c.lastUpdate = now
-			c.mu.Unlock()
+	}
+	if c.d.freezeCheck != nil {
+		c.fingerprint = fingerprint(v)
+	}
+	if c.d.historySize > 0 {
+		if c.history == nil {
+			c.history = newRing[HistoryEntry](c.d.historySize)
 		}
-		return v, err
-	})
-	return val, err
+		c.history.add(HistoryEntry{Value: v, At: now})
+	}
+	if c.createdAt.IsZero() || c.overAge(now) {
+		c.createdAt = now
+	}
+	c.lastUpdate = now
+	c.validUntil = time.Time{}
+	c.generation = atomic.LoadInt64(&c.d.generation)
+	c.err = nil
+	c.failures = 0
+	return first
+}
+
+// firstLoaded calls the function set by WithOnFirstLoad if any. c.mu must not
+// be held.
+func (c *call) firstLoaded(v interface{}) {
+	if c.d.onFirstLoad != nil {
+		c.d.onFirstLoad(c.key, v)
+	}
+}
+
+// value returns the result, and false if it has never been set or has been
+// garbage collected. With WithValuePool, it is a copy of the cached value.
+// c.mu must be held.
+func (c *call) value() (interface{}, bool) {
+	if c.lastUpdate.IsZero() {
+		return nil, false
+	}
+	if c.d.weakValues {
+		return resolveWeak(c.result)
+	}
+	if c.d.valuePool != nil {
+		return c.d.valuePool.copy(nil, c.result), true
+	}
+	return c.result, true
+}
+
+// ttl returns the expiration of the current result, which is pinned by DoUntil
+// if it was stored by that, and capped by WithMaxTotalAge. It is negative if
+// the result was stored before the last Bump. c.mu must be held.
+func (c *call) ttl() int64 {
+	if c.generation != atomic.LoadInt64(&c.d.generation) {
+		return -1
+	}
+	ttl := atomic.LoadInt64(&c.expiration)
+	if !c.validUntil.IsZero() {
+		ttl = int64(c.validUntil.Sub(c.lastUpdate))
+	}
+	if c.d.maxTotalAge > 0 {
+		if limit := int64(c.createdAt.Sub(c.lastUpdate)) + c.d.maxTotalAge; limit < ttl {
+			ttl = limit
+		}
+	}
+	return ttl
+}
+
+// overAge reports whether the result has been kept for longer than
+// WithMaxTotalAge since it was first stored at now. c.mu must be held.
+func (c *call) overAge(now time.Time) bool {
+	return c.d.maxTotalAge > 0 && !c.createdAt.IsZero() && int64(now.Sub(c.createdAt)) > c.d.maxTotalAge
+}
+
+// timing returns the expiration and updateInterval of c.
+func (c *call) timing() (expiration, updateInterval int64) {
+	return atomic.LoadInt64(&c.expiration), atomic.LoadInt64(&c.updateInterval)
+}
+
+// refresh updates the result in the background. It is kept out of do so that
+// the goroutine and its captured arguments are only allocated when a refresh
+// is actually launched.
+// With WithMaxConcurrentRefreshes, it is queued to the scheduler instead.
+func (c *call) refresh(w work) {
+	if c.d.readOnly || c.quarantined(w.now(c.d.clock)) {
+		return
+	}
+	// At most one refresh of a key is outstanding unless the key is refreshed
+	// in parallel, since the goroutines waiting for an update in flight would
+	// otherwise pile up while fn is slow.
+	if !c.parallel && !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	// The delay of WithStartupJitter is only for the first refresh.
+	atomic.StoreInt64(&c.startupDelay, 0)
+	w = w.background()
+	if c.d.scheduler != nil {
+		c.d.scheduler.submit(c, w)
+		return
+	}
+	go c.backgroundUpdate(w)
+}
+
+// backgroundUpdate updates the result in the background and notifies it.
+func (c *call) backgroundUpdate(w work) {
+	atomic.AddInt64(&c.d.stats.refreshes, 1)
+	atomic.AddInt64(&c.stats.refreshes, 1)
+	c.update(w)
+	if !c.parallel {
+		atomic.StoreInt32(&c.refreshing, 0)
+	}
+	c.d.emit(EventRefresh, c.key)
+	if c.d.refreshDone != nil {
+		c.d.refreshDone(c.key)
+	}
+}
+
+func (c *call) update(w work) (interface{}, error) {
+	if w.hasFingerprint && !w.async && !c.parallel && c.d.consistencyCheck != nil {
+		defer c.checkConsistency(w.fingerprint)()
+	}
+	atomic.AddInt64(&c.waiters, 1)
+	defer atomic.AddInt64(&c.waiters, -1)
+
+	if c.parallel {
+		c.flown(w, true)
+		return c.execute(w)
+	}
+	if w.ctx != nil && w.ctx.Done() != nil {
+		return c.updateContext(w)
+	}
+	for {
+		var leader bool
+		val, err, _ := c.group.Do("update", func() (interface{}, error) {
+			leader = true
+			return c.lead(w)
+		})
+		c.flown(w, leader)
+		if !leader && isCanceledLeader(err) {
+			continue
+		}
+		return val, err
+	}
+}
+
+// canceledLeader is the error of an execution whose caller's ctx is done, with
+// WithLeaderHandoff.
+type canceledLeader struct {
+	err error
+}
+
+func (e canceledLeader) Error() string {
+	return e.err.Error()
+}
+
+func isCanceledLeader(err error) bool {
+	_, ok := err.(canceledLeader)
+	return ok
+}
+
+// lead executes w for the callers of update. With WithLeaderHandoff, the error
+// is marked as canceledLeader if ctx of w is done, so that the followers take
+// over the execution instead of sharing the error. The leader itself gets the
+// original error from leaderError.
+func (c *call) lead(w work) (interface{}, error) {
+	v, err := c.execute(w)
+	if err != nil && c.d.leaderHandoff && w.ctx != nil && w.ctx.Err() != nil {
+		return v, canceledLeader{err: err}
+	}
+	return v, err
+}
+
+func leaderError(err error) error {
+	if e, ok := err.(canceledLeader); ok {
+		return e.err
+	}
+	return err
+}
+
+// flown counts a caller of update for FlightStats, which is the leader if it
+// executed the function of w, or else a follower sharing the result. The
+// updates in the background are not counted.
+func (c *call) flown(w work, leader bool) {
+	if w.async {
+		return
+	}
+	if leader {
+		atomic.AddInt64(&c.stats.leaders, 1)
+		atomic.AddInt64(&c.d.stats.leaders, 1)
+	} else {
+		atomic.AddInt64(&c.stats.followers, 1)
+		atomic.AddInt64(&c.d.stats.followers, 1)
+	}
+}
+
+// updateContext is like update, but gives up waiting for the result of another
+// caller when ctx of w is done, and returns the previous result if any along
+// with the error of ctx. The execution of fn continues for the other callers,
+// with ctx of the caller that started it, which waits for fn to return. With
+// WithLeaderHandoff, a caller whose ctx is not done executes fn again if the
+// caller that started it fails due to its ctx.
+func (c *call) updateContext(w work) (interface{}, error) {
+	for {
+		started := make(chan struct{})
+		ch := c.group.DoChan("update", func() (interface{}, error) {
+			close(started)
+			return c.lead(w)
+		})
+		select {
+		case r := <-ch:
+			leader := isClosed(started)
+			c.flown(w, leader)
+			if !leader && isCanceledLeader(r.Err) && w.ctx.Err() == nil {
+				continue
+			}
+			return r.Val, leaderError(r.Err)
+		case <-w.ctx.Done():
+			select {
+			case <-started:
+				r := <-ch
+				c.flown(w, true)
+				return r.Val, leaderError(r.Err)
+			default:
+			}
+			c.flown(w, false)
+			c.mu.RLock()
+			v, _ := c.value()
+			c.mu.RUnlock()
+			return v, w.ctx.Err()
+		}
+	}
+}
+
+// isClosed reports whether ch is closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// execute executes fn and stores the result unless another update has already
+// made the result valid.
+func (c *call) execute(w work) (interface{}, error) {
+	now := w.now(c.d.clock)
+	_, updateInterval := c.timing()
+	c.mu.RLock()
+	prev, ok := c.value()
+	t := c.age(now)
+	expiration := c.ttl()
+	c.mu.RUnlock()
+	if ok && !w.force && t < expiration && (updateInterval == 0 || t < updateInterval) {
+		// If the short term timing of c.group.Do does not match, use the previous result.
+		return prev, nil
+	}
+	if ok && !c.leased() {
+		return prev, nil
+	}
+	if !ok && c.d.overflow != nil {
+		if v, ok := c.promote(); ok {
+			return v, nil
+		}
+	}
+	if c.d.readOnly {
+		if ok {
+			return prev, nil
+		}
+		return nil, ErrNotCached
+	}
+	if ok && w.async && c.d.maxTotalAge > 0 {
+		// Updates in the background must not extend the result beyond the
+		// maximum total age; only a synchronous reload starts it again.
+		c.mu.RLock()
+		over := c.overAge(now)
+		c.mu.RUnlock()
+		if over {
+			return prev, nil
+		}
+	}
+	if c.d.minRefreshInterval > 0 && !c.d.allowRun(c.key, now) {
+		if ok {
+			return prev, nil
+		}
+		return nil, ErrRateLimited
+	}
+	if c.breakerOpen(now) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		if c.d.errorValue == NilOnError {
+			return nil, c.err
+		}
+		v, _ := c.value()
+		return v, c.err
+	}
+	if c.d.debugStacks {
+		c.recordStack()
+	}
+	if c.d.loads != nil && !w.async {
+		if !c.d.acquireLoad() {
+			return nil, ErrTooManyLoads
+		}
+		defer func() { <-c.d.loads }()
+	}
+	// A synchronous reload of an expired result waits for the batch instead
+	// of calling fn.
+	w.batched = ok && !w.async && !w.force && c.d.batch != nil
+	v, err := c.run(w)
+	v, a := unwrap(v)
+	atomic.AddInt64(&c.d.stats.executions, 1)
+	if err != nil {
+		atomic.AddInt64(&c.d.stats.errors, 1)
+		atomic.AddInt64(&c.stats.errors, 1)
+	}
+	if err == nil && c.d.discardOnCancel && w.ctx != nil && w.ctx.Err() != nil {
+		v, err = nil, w.ctx.Err()
+	}
+	if !ok && c.d.stampedeFn != nil {
+		if n := int(atomic.LoadInt64(&c.waiters)); n >= c.d.stampede {
+			c.d.stampedeFn(c.key, n)
+		}
+	}
+	// A partial result of DoPartial is cached along with the error.
+	cacheable := err == nil || a.keep
+	if cacheable && c.d.validator != nil {
+		if verr := c.d.validator(c.key, v); verr != nil {
+			v, cacheable = nil, false
+			if err == nil {
+				err = verr
+			}
+		}
+	}
+	if cacheable && !a.transformed {
+		v = c.d.transform(v)
+	}
+	if err == nil && c.d.adaptiveEqual != nil && ok {
+		c.adaptTTL(prev, v)
+	}
+	var first, drain bool
+	var streams []func(interface{})
+	tombstoned := cacheable && c.d.tombstoned(c.key, w.now(c.d.clock))
+	c.mu.Lock()
+	// A result of a tombstoned key may have been computed from the state
+	// before the removal, so it is returned without being cached. Parallel
+	// updates and forced ones may finish out of order.
+	if cacheable && !tombstoned && ((!c.parallel && !w.force) || !now.Before(c.lastUpdate)) {
+		first = c.store(v, now)
+		if ok {
+			// The delay of WithStartupJitter is only until the first
+			// update after the load, including a synchronous one.
+			atomic.StoreInt64(&c.startupDelay, 0)
+		}
+		c.validUntil = w.validUntil
+		if a.hasToken {
+			c.token = a.token
+		}
+		streams = c.streams
+	}
+	if err != nil {
+		c.err = err
+		c.errorAt = w.now(c.d.clock)
+		c.failures++
+		if c.d.errorHistory > 0 {
+			if c.errors == nil {
+				c.errors = newRing[ErrorRecord](c.d.errorHistory)
+			}
+			c.errors.add(ErrorRecord{Err: err, At: c.errorAt})
+		}
+		drain = c.d.removeAfter > 0 && c.failures >= c.d.removeAfter && !c.isPinned()
+	}
+	ret := v
+	if err != nil {
+		switch c.d.errorValue {
+		case NilOnError:
+			ret = nil
+		case LastGoodOnError:
+			ret, _ = c.value()
+		}
+	}
+	c.mu.Unlock()
+	if first {
+		c.firstLoaded(v)
+	}
+	for _, onValue := range streams {
+		onValue(v)
+	}
+	if drain {
+		c.d.removeCall(c, EvictFailures)
+	}
+	return ret, err
+}
+
+// ErrRateLimited is returned when fn cannot be executed due to
+// WithMinRefreshInterval and there is no previous result.
+var ErrRateLimited = errors.New("callcache: rate limited")
+
+// ErrTooManyLoads is returned when the limit of WithMaxConcurrentLoads is
+// reached and it is set to fail fast.
+var ErrTooManyLoads = errors.New("callcache: too many concurrent loads")
+
+// acquireLoad acquires a slot of WithMaxConcurrentLoads. It reports false
+// without waiting if the limit is reached and it is set to fail fast.
+func (d *Dispatcher) acquireLoad() bool {
+	if d.loadsFailFast {
+		select {
+		case d.loads <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	d.loads <- struct{}{}
+	return true
+}
+
+// adaptTTL doubles the expiration up to the maximum if v equals prev, and
+// resets it to the minimum otherwise.
+func (c *call) adaptTTL(prev, v interface{}) {
+	expiration := c.d.adaptiveMin
+	if c.d.adaptiveEqual(prev, v) {
+		expiration = 2 * atomic.LoadInt64(&c.expiration)
+		if expiration > c.d.adaptiveMax {
+			expiration = c.d.adaptiveMax
+		}
+	}
+	atomic.StoreInt64(&c.expiration, expiration)
+}
+
+// run calls the function of w under the refresh gate if any, and within the
+// timeout set by DoWithTimeout, on the serial executor if any.
+func (c *call) run(w work) (interface{}, error) {
+	if c.d.refreshGate != nil {
+		if l := c.d.refreshGate(c.key); l != nil {
+			l.Lock()
+			defer l.Unlock()
+		}
+	}
+	invoke := c.d.invoke
+	if w.batched {
+		// The loader is invoked for the batch, so the waits for it do not
+		// occupy the serial executor.
+		invoke = func(work) (interface{}, error) { return c.d.batch.get(c.key) }
+	}
+	if timeout := atomic.LoadInt64(&c.timeout); timeout > 0 {
+		return w.callTimeout(time.Duration(timeout), invoke)
+	}
+	return invoke(w)
+}
+
+// breakerOpen reports whether the circuit breaker prevents fn from being called.
+// Once the breaker has opened, it stays open for the cooldown from the last
+// failure, which is also the failure of a probe in the half-open state.
+func (c *call) breakerOpen(now time.Time) bool {
+	if c.d.breakerFailures <= 0 {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.failures >= c.d.breakerFailures && now.Sub(c.errorAt) < time.Duration(c.d.breakerCooldown)
 }
@@ -0,0 +1,2147 @@
+package callcache_test
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func BenchmarkDispatcher_Do_hit(b *testing.B) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+	if _, err := dispatcher.Do("key", fn); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dispatcher.Do("key", fn)
+	}
+}
+
+func BenchmarkDispatcher_Do_hitParallel(b *testing.B) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+	if _, err := dispatcher.Do("key", fn); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			dispatcher.Do("key", fn)
+		}
+	})
+}
+
+// BenchmarkDispatcher_Do_hitRefreshMachinery compares the hits with and
+// without the updateInterval, which must not differ in allocations since the
+// goroutine of a background refresh is only created when it is launched.
+func BenchmarkDispatcher_Do_hitRefreshMachinery(b *testing.B) {
+	for _, updateInterval := range []time.Duration{0, 10 * time.Second} {
+		b.Run("updateInterval="+updateInterval.String(), func(b *testing.B) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, updateInterval)
+			fn := func() (interface{}, error) {
+				return "value", nil
+			}
+			if _, err := dispatcher.Do("key", fn); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dispatcher.Do("key", fn)
+			}
+		})
+	}
+}
+
+// BenchmarkDispatcher_Do_coalesced measures the callers sharing the executions
+// of fn, since the results expire immediately.
+func BenchmarkDispatcher_Do_coalesced(b *testing.B) {
+	dispatcher := callcache.NewDispatcher(1*time.Nanosecond, 0)
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			dispatcher.Do("key", fn)
+		}
+	})
+}
+
+func BenchmarkDispatcher_Do_newKey(b *testing.B) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+	keys := make([]string, b.N)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, key := range keys {
+		dispatcher.Do(key, fn)
+	}
+}
+
+func BenchmarkDispatcher_Do_multiKeyParallel(b *testing.B) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		dispatcher.Do(keys[i], fn)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			dispatcher.Do(keys[i%len(keys)], fn)
+			i++
+		}
+	})
+}
+
+// TestDispatcher_Do_hitAllocs guards the hit path, which must not allocate,
+// so that a regression fails the tests rather than only showing up in the
+// benchmarks above.
+func TestDispatcher_Do_hitAllocs(t *testing.T) {
+	for _, updateInterval := range []time.Duration{0, 10 * time.Second} {
+		dispatcher := callcache.NewDispatcher(1*time.Minute, updateInterval)
+		fn := func() (interface{}, error) {
+			return "value", nil
+		}
+		if _, err := dispatcher.Do("key", fn); err != nil {
+			t.Fatal(err)
+		}
+
+		key := string([]byte("key"))
+		if n := testing.AllocsPerRun(100, func() { dispatcher.Do(key, fn) }); n != 0 {
+			t.Errorf("AllocsPerRun with updateInterval %v = %v, want 0", updateInterval, n)
+		}
+	}
+}
+
+func TestDispatcher_Health(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(20*time.Millisecond, 1*time.Nanosecond)
+	errBackend := errors.New("backend is down")
+
+	if _, err := dispatcher.Do("key", func() (interface{}, error) {
+		return "value", nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if h := dispatcher.Health(); h.Entries != 1 || h.Expired != 0 || h.LastError != nil {
+		t.Errorf("Health() = %+v, want healthy", h)
+	}
+
+	failing := func() (interface{}, error) {
+		return nil, errBackend
+	}
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := dispatcher.Do("key", failing); err != errBackend {
+			t.Fatalf("Do() error = %v, want %v", err, errBackend)
+		}
+	}
+
+	h := dispatcher.Health()
+	if h.Entries != 1 {
+		t.Errorf("Entries = %d, want 1", h.Entries)
+	}
+	if h.Expired != 1 {
+		t.Errorf("Expired = %d, want 1", h.Expired)
+	}
+	if h.OldestAge < 30*time.Millisecond {
+		t.Errorf("OldestAge = %v, want >= 30ms", h.OldestAge)
+	}
+	if h.LastError != errBackend || h.LastErrorAt.IsZero() {
+		t.Errorf("LastError = %v at %v, want %v", h.LastError, h.LastErrorAt, errBackend)
+	}
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Nanosecond, 0, callcache.WithCircuitBreaker(2, 50*time.Millisecond))
+	errBackend := errors.New("backend is down")
+
+	var calls int
+	failing := func() (interface{}, error) {
+		calls++
+		return nil, errBackend
+	}
+	succeeding := func() (interface{}, error) {
+		calls++
+		return "value", nil
+	}
+	do := func(fn func() (interface{}, error), wantCalls int, wantErr error) {
+		t.Helper()
+		calls = 0
+		if _, err := dispatcher.Do("key", fn); err != wantErr {
+			t.Errorf("Do() error = %v, want %v", err, wantErr)
+		}
+		if calls != wantCalls {
+			t.Errorf("fn was called %d times, want %d", calls, wantCalls)
+		}
+	}
+
+	// closed
+	do(failing, 1, errBackend)
+	do(failing, 1, errBackend)
+	// open
+	do(failing, 0, errBackend)
+	do(succeeding, 0, errBackend)
+
+	// half-open, and the probe fails
+	time.Sleep(60 * time.Millisecond)
+	do(failing, 1, errBackend)
+	do(succeeding, 0, errBackend)
+
+	// half-open, and the probe succeeds
+	time.Sleep(60 * time.Millisecond)
+	do(succeeding, 1, nil)
+	// closed
+	do(failing, 1, errBackend)
+	do(succeeding, 1, nil)
+}
+
+func TestWithTransform(t *testing.T) {
+	var transforms int32
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+		callcache.WithTransform(func(v interface{}) interface{} {
+			atomic.AddInt32(&transforms, 1)
+			return v.(int) * 2
+		}),
+		callcache.WithTransform(func(v interface{}) interface{} {
+			return strconv.Itoa(v.(int))
+		}),
+	)
+	raw := 1
+	fn := func() (interface{}, error) {
+		return raw, nil
+	}
+
+	for i := 0; i < 10; i++ {
+		if v, err := dispatcher.Do("key", fn); v != "2" || err != nil {
+			t.Errorf("Do() = %v, %v, want 2, nil", v, err)
+		}
+	}
+	if transforms != 1 {
+		t.Errorf("transformed %d times for reads, want 1", transforms)
+	}
+
+	raw = 2
+	dispatcher.Expire("key")
+	if v, _ := dispatcher.Do("key", fn); v != "4" {
+		t.Errorf("Do() after refresh = %v, want 4", v)
+	}
+	dispatcher.Set("key", 3)
+	if v, _ := dispatcher.Peek("key"); v != "6" {
+		t.Errorf("Peek() after Set() = %v, want 6", v)
+	}
+	dispatcher.Do("failing", func() (interface{}, error) { return nil, errors.New("failed") })
+	if transforms != 3 {
+		t.Errorf("transformed %d times, want 3", transforms)
+	}
+
+	// The result kept by DoConditional is not transformed again.
+	conditional := func(string) (interface{}, string, bool, error) { return 5, "", true, nil }
+	dispatcher.Expire("key")
+	if v, _ := dispatcher.DoConditional("key", conditional); v != "6" {
+		t.Errorf("DoConditional() not modified = %v, want 6", v)
+	}
+}
+
+func TestWithResultValidator(t *testing.T) {
+	errEmpty := errors.New("empty result")
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithResultValidator(func(key string, v interface{}) error {
+		if len(v.([]string)) == 0 {
+			return errEmpty
+		}
+		return nil
+	}))
+
+	var calls int
+	fn := func() (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return []string{}, nil
+		}
+		return []string{"data"}, nil
+	}
+
+	if v, err := dispatcher.Do("key", fn); v != nil || err != errEmpty {
+		t.Errorf("Do() = %v, %v, want <nil>, %v", v, err, errEmpty)
+	}
+	v, err := dispatcher.Do("key", fn)
+	if err != nil || len(v.([]string)) != 1 {
+		t.Errorf("Do() = %v, %v, want [data], <nil>", v, err)
+	}
+	if _, err := dispatcher.Do("key", fn); err != nil || calls != 2 {
+		t.Errorf("fn was called %d times, want 2", calls)
+	}
+}
+
+func TestDispatcher_Take_concurrent(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+
+	for i := 0; i < 100; i++ {
+		dispatcher.Do("key", func() (interface{}, error) {
+			return i, nil
+		})
+
+		var taken int32
+		var wg sync.WaitGroup
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, ok := dispatcher.Take("key"); ok {
+					atomic.AddInt32(&taken, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if taken != 1 {
+			t.Fatalf("Take succeeded %d times, want 1", taken)
+		}
+	}
+}
+
+func TestWithKeyHasher(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second, callcache.WithKeyHasher(callcache.SHA256KeyHasher(64)))
+
+	prefix := strings.Repeat("x", 1000)
+	keys := []string{prefix + "1", prefix + "2", "short"}
+	for _, key := range keys {
+		key := key
+		dispatcher.Do(key, func() (interface{}, error) {
+			return key, nil
+		})
+	}
+
+	got := dispatcher.Keys()
+	sort.Strings(got)
+	hasher := callcache.SHA256KeyHasher(64)
+	want := []string{hasher(keys[0]), hasher(keys[1]), "short"}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %v, want %v", got, want)
+	}
+	for _, key := range got {
+		if len(key) > 64 {
+			t.Errorf("len(%q) = %d, want <= 64", key, len(key))
+		}
+	}
+
+	for _, key := range keys {
+		v, _ := dispatcher.Do(key, func() (interface{}, error) {
+			return nil, errors.New("must not be called")
+		})
+		if v != key {
+			t.Errorf("Do(%.10q...) = %.10q..., want the cached value", key, v)
+		}
+	}
+
+	dispatcher.Remove(keys[0])
+	if _, ok := dispatcher.Take(keys[1]); !ok {
+		t.Error("Take() = false, want true")
+	}
+	if got := dispatcher.Keys(); len(got) != 1 || got[0] != "short" {
+		t.Errorf("Keys() = %v, want [short]", got)
+	}
+}
+
+func TestDispatcher_DoShared(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "everything", nil
+	}
+
+	keys := []string{"key1", "key2", "key3"}
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			dispatcher.DoShared(key, "refresh-all", fn)
+		}(key)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn was called %d times, want 1", calls)
+	}
+	for _, key := range keys {
+		v, _ := dispatcher.Do(key, func() (interface{}, error) {
+			return nil, errors.New("must not be called")
+		})
+		if v != "everything" {
+			t.Errorf("Do(%q) = %v, want everything", key, v)
+		}
+	}
+}
+
+func TestDispatcher_DoCached(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+	dispatcher.Set("present", "value")
+	dispatcher.Set("expired", "value")
+	clock.Add(30 * time.Second)
+	dispatcher.Set("present", "value")
+	clock.Add(31 * time.Second)
+
+	tests := []struct {
+		key     string
+		want    interface{}
+		wantErr error
+	}{
+		{key: "present", want: "value"},
+		{key: "absent", wantErr: callcache.ErrNotCached},
+		{key: "expired", wantErr: callcache.ErrNotCached},
+	}
+	for _, tt := range tests {
+		if v, err := dispatcher.DoCached(tt.key); v != tt.want || err != tt.wantErr {
+			t.Errorf("DoCached(%s) = %v, %v, want %v, %v", tt.key, v, err, tt.want, tt.wantErr)
+		}
+	}
+	if s := dispatcher.Stats(); s.Executions != 0 {
+		t.Errorf("Stats().Executions = %d, want 0", s.Executions)
+	}
+}
+
+func TestDispatcher_SetExpiration(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []callcache.Option
+		wantOld int
+	}{
+		{name: "new keys only", wantOld: 1},
+		{name: "propagated", opts: []callcache.Option{callcache.WithSettingsPropagation()}, wantOld: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, tt.opts...)
+
+			calls := make(map[string]int)
+			do := func(key string) {
+				dispatcher.Do(key, func() (interface{}, error) {
+					calls[key]++
+					return calls[key], nil
+				})
+			}
+
+			do("old")
+			dispatcher.SetExpiration(1 * time.Nanosecond)
+			for i := 0; i < 2; i++ {
+				time.Sleep(1 * time.Millisecond)
+				do("old")
+				do("new")
+			}
+
+			if calls["old"] != tt.wantOld {
+				t.Errorf("fn of old key was called %d times, want %d", calls["old"], tt.wantOld)
+			}
+			if calls["new"] != 2 {
+				t.Errorf("fn of new key was called %d times, want 2", calls["new"])
+			}
+		})
+	}
+}
+
+func TestDispatcher_SetUpdateInterval(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithSettingsPropagation())
+
+	var calls int32
+	fn := func() (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+
+	dispatcher.Do("key", fn)
+	dispatcher.SetUpdateInterval(1 * time.Nanosecond)
+	time.Sleep(1 * time.Millisecond)
+	if v, _ := dispatcher.Do("key", fn); v != int32(1) {
+		t.Errorf("Do() = %v, want the previous result", v)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) != 2; i++ {
+		time.Sleep(1 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("fn was called %d times, want 2", n)
+	}
+}
+
+func TestWithRefreshDoneHook(t *testing.T) {
+	refreshed := make(chan string, 1)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 1*time.Nanosecond, callcache.WithRefreshDoneHook(func(key string) {
+		refreshed <- key
+	}))
+
+	var calls int32
+	fn := func() (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+	dispatcher.Do("key", fn)
+	time.Sleep(1 * time.Millisecond)
+	dispatcher.Do("key", fn)
+
+	select {
+	case key := <-refreshed:
+		if key != "key" {
+			t.Errorf("hook was called with %q, want key", key)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("hook was not called")
+	}
+	if v, _ := dispatcher.Do("key", fn); v != int32(2) {
+		t.Errorf("Do() = %v, want the refreshed result", v)
+	}
+}
+
+func TestDispatcher_Do_oneRefreshPerKey(t *testing.T) {
+	refreshed := make(chan struct{}, 100)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 1*time.Nanosecond, callcache.WithRefreshDoneHook(func(string) {
+		refreshed <- struct{}{}
+	}))
+	dispatcher.Do("key", func() (interface{}, error) { return "old", nil })
+
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		return "new", nil
+	}
+	time.Sleep(1 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if v, _ := dispatcher.Do("key", fn); v != "old" {
+			t.Fatalf("Do() = %v, want old", v)
+		}
+	}
+	close(release)
+	<-refreshed
+
+	if n := dispatcher.Stats().Refreshes; n != 1 {
+		t.Errorf("Refreshes = %d, want 1", n)
+	}
+}
+
+func TestDispatcher_DoOrDefault(t *testing.T) {
+	refreshed := make(chan string, 1)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second, callcache.WithRefreshDoneHook(func(key string) {
+		refreshed <- key
+	}))
+
+	t.Run("miss returns default and warms", func(t *testing.T) {
+		release := make(chan struct{})
+		var calls int32
+		fn := func() (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return "value", nil
+		}
+		for i := 0; i < 3; i++ {
+			if v := dispatcher.DoOrDefault("key", "default", fn); v != "default" {
+				t.Errorf("DoOrDefault() = %v, want default", v)
+			}
+		}
+		close(release)
+		// The calls while the first refresh is outstanding do not start others.
+		<-refreshed
+		select {
+		case key := <-refreshed:
+			t.Errorf("another refresh of %s was started", key)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if calls != 1 {
+			t.Errorf("fn was called %d times, want 1", calls)
+		}
+	})
+
+	t.Run("hit", func(t *testing.T) {
+		v := dispatcher.DoOrDefault("key", "default", func() (interface{}, error) {
+			return nil, errors.New("must not be called")
+		})
+		if v != "value" {
+			t.Errorf("DoOrDefault() = %v, want value", v)
+		}
+	})
+
+	t.Run("error returns default", func(t *testing.T) {
+		fn := func() (interface{}, error) {
+			return "partial", errors.New("backend is down")
+		}
+		for i := 0; i < 2; i++ {
+			if v := dispatcher.DoOrDefault("failing", "default", fn); v != "default" {
+				t.Errorf("DoOrDefault() = %v, want default", v)
+			}
+			<-refreshed
+		}
+	})
+}
+
+func TestWithStampedeObserver(t *testing.T) {
+	var observed []int
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second, callcache.WithStampedeObserver(5, func(key string, concurrent int) {
+		observed = append(observed, concurrent)
+	}))
+
+	fn := func() (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return "value", nil
+	}
+	stampede := func(n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				dispatcher.Do("key", fn)
+			}()
+		}
+		wg.Wait()
+	}
+
+	stampede(2)
+	if len(observed) != 0 {
+		t.Errorf("observer was called with %v, want no calls", observed)
+	}
+
+	dispatcher.Remove("key")
+	stampede(10)
+	if len(observed) != 1 || observed[0] < 5 || observed[0] > 10 {
+		t.Errorf("observer was called with %v, want one call with 5..10", observed)
+	}
+
+	// hits do not wait for fn
+	stampede(10)
+	if len(observed) != 1 {
+		t.Errorf("observer was called with %v, want one call", observed)
+	}
+}
+
+func TestWithStaleOnError(t *testing.T) {
+	errBackend := errors.New("backend is down")
+	failing := func() (interface{}, error) {
+		return "partial", errBackend
+	}
+
+	tests := []struct {
+		name string
+		opts []callcache.Option
+		want []interface{}
+	}{
+		{name: "default", want: []interface{}{"partial", "partial"}},
+		{name: "stale on error", opts: []callcache.Option{callcache.WithStaleOnError()}, want: []interface{}{nil, "value"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Nanosecond, 0, tt.opts...)
+
+			// no previous result
+			if v, err := dispatcher.Do("key", failing); v != tt.want[0] || err != errBackend {
+				t.Errorf("Do() = %v, %v, want %v, %v", v, err, tt.want[0], errBackend)
+			}
+
+			dispatcher.Do("key", func() (interface{}, error) {
+				return "value", nil
+			})
+			time.Sleep(1 * time.Millisecond)
+			results := dispatcher.DoBatch([]string{"key"}, func(string) (interface{}, error) {
+				return failing()
+			})
+			if r := results["key"]; r.Val != tt.want[1] || r.Err != errBackend {
+				t.Errorf("DoBatch() = %+v, want {Val:%v Err:%v}", r, tt.want[1], errBackend)
+			}
+		})
+	}
+}
+
+func TestWithErrorValuePolicy(t *testing.T) {
+	errBackend := errors.New("backend is down")
+	failing := func() (interface{}, error) {
+		return "returned", errBackend
+	}
+
+	tests := []struct {
+		name     string
+		policy   callcache.ErrorValuePolicy
+		want     interface{}
+		wantOpen interface{}
+	}{
+		{name: "returned", policy: callcache.ReturnedOnError, want: "returned", wantOpen: "good"},
+		{name: "nil", policy: callcache.NilOnError, want: nil, wantOpen: nil},
+		{name: "last good", policy: callcache.LastGoodOnError, want: "good", wantOpen: "good"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+				callcache.WithClock(clock),
+				callcache.WithErrorValuePolicy(tt.policy),
+				callcache.WithCircuitBreaker(1, 1*time.Hour),
+			)
+			dispatcher.Set("key", "good")
+			clock.Add(1*time.Minute + 1)
+
+			if v, err := dispatcher.Do("key", failing); v != tt.want || err != errBackend {
+				t.Errorf("Do() = %v, %v, want %v, %v", v, err, tt.want, errBackend)
+			}
+			// The breaker opens without executing fn.
+			if v, err := dispatcher.Do("key", failing); v != tt.wantOpen || err != errBackend {
+				t.Errorf("Do() with the open breaker = %v, %v, want %v, %v", v, err, tt.wantOpen, errBackend)
+			}
+			if v, _ := dispatcher.Do("missing", failing); tt.policy != callcache.ReturnedOnError && v != nil {
+				t.Errorf("Do() without a previous result = %v, want nil", v)
+			}
+		})
+	}
+}
+
+func TestDispatcher_DoReader(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+	content := strings.Repeat("payload", 1000)
+
+	var calls int32
+	fn := func() (io.Reader, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return strings.NewReader(content), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := dispatcher.DoReader("key", fn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b, err := io.ReadAll(r)
+			if err != nil || string(b) != content {
+				t.Errorf("read %d bytes with %v, want %d bytes", len(b), err, len(content))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn was called %d times, want 1", calls)
+	}
+}
+
+func TestDispatcher_DoReader_unexpectedType(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+	dispatcher.Set("key", "string")
+
+	r, err := dispatcher.DoReader("key", func() (io.Reader, error) {
+		t.Error("fn must not be called for the cached result")
+		return strings.NewReader("content"), nil
+	})
+	if r != nil || !errors.Is(err, callcache.ErrUnexpectedType) {
+		t.Errorf("DoReader() = %v, %v, want nil, %v", r, err, callcache.ErrUnexpectedType)
+	}
+}
+
+func TestWithParallelRefresh(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Nanosecond, 0, callcache.WithParallelRefresh(func(key string) bool {
+		return strings.HasPrefix(key, "parallel:")
+	}))
+
+	tests := []struct {
+		key  string
+		want int32
+	}{
+		{key: "parallel:key", want: 2},
+		{key: "serial:key", want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			var running, maxRunning, calls int32
+			fn := func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					m := atomic.LoadInt32(&maxRunning)
+					if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+						break
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+				return "value", nil
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					dispatcher.Do(tt.key, fn)
+				}()
+			}
+			wg.Wait()
+
+			if calls != tt.want || maxRunning != tt.want {
+				t.Errorf("fn was called %d times with %d at once, want %d", calls, maxRunning, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatcher_Config(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second, callcache.WithParallelRefresh(func(key string) bool {
+		return key == "parallel"
+	}))
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	dispatcher.Do("before", fn)
+	dispatcher.Set("parallel", "value")
+	dispatcher.SetExpiration(2 * time.Minute)
+	dispatcher.SetUpdateInterval(20 * time.Second)
+	dispatcher.DoWithSeed("after", "seed", fn)
+
+	tests := []struct {
+		key  string
+		want callcache.KeyConfig
+	}{
+		{key: "before", want: callcache.KeyConfig{Expiration: 1 * time.Minute, UpdateInterval: 10 * time.Second}},
+		{key: "parallel", want: callcache.KeyConfig{Expiration: 1 * time.Minute, UpdateInterval: 10 * time.Second, ParallelRefresh: true}},
+		{key: "after", want: callcache.KeyConfig{Expiration: 2 * time.Minute, UpdateInterval: 20 * time.Second}},
+	}
+	for _, tt := range tests {
+		if got, ok := dispatcher.Config(tt.key); !ok || got != tt.want {
+			t.Errorf("Config(%q) = %+v, %v, want %+v, true", tt.key, got, ok, tt.want)
+		}
+	}
+
+	if _, ok := dispatcher.Config("unknown"); ok {
+		t.Error("Config() = true for unknown key, want false")
+	}
+}
+
+func TestWithRefreshGate(t *testing.T) {
+	var gate sync.Mutex
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithRefreshGate(func(key string) sync.Locker {
+		if strings.HasPrefix(key, "gated") {
+			return &gate
+		}
+		return nil
+	}))
+
+	var running, maxRunning int32
+	fn := func() (interface{}, error) {
+		if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return "value", nil
+	}
+
+	run := func(keys ...string) int32 {
+		atomic.StoreInt32(&maxRunning, 0)
+		var wg sync.WaitGroup
+		for _, key := range keys {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				dispatcher.Do(key, fn)
+			}(key)
+		}
+		wg.Wait()
+		return atomic.LoadInt32(&maxRunning)
+	}
+
+	if n := run("gated1", "gated2", "gated3"); n != 1 {
+		t.Errorf("%d gated fn ran at once, want 1", n)
+	}
+	if n := run("free1", "free2", "free3"); n < 2 {
+		t.Errorf("%d ungated fn ran at once, want 2 or more", n)
+	}
+}
+
+func TestWithResourceGroups(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithResourceGroups(func(key string) string {
+		group, _, _ := strings.Cut(key, ":")
+		return group
+	}))
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	maxRunning := make(map[string]int)
+	var total, maxTotal int
+	fn := func(group string) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			mu.Lock()
+			running[group]++
+			total++
+			if running[group] > maxRunning[group] {
+				maxRunning[group] = running[group]
+			}
+			if total > maxTotal {
+				maxTotal = total
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			running[group]--
+			total--
+			mu.Unlock()
+			return "value", nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"a:1", "a:2", "a:3", "b:1", "b:2", "b:3"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			group, _, _ := strings.Cut(key, ":")
+			dispatcher.Do(key, fn(group))
+		}(key)
+	}
+	wg.Wait()
+
+	for _, group := range []string{"a", "b"} {
+		if n := maxRunning[group]; n != 1 {
+			t.Errorf("%d fn of group %s ran at once, want 1", n, group)
+		}
+	}
+	if maxTotal != 2 {
+		t.Errorf("%d fn ran at once across the groups, want 2", maxTotal)
+	}
+}
+
+func TestWithAdaptiveTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(i int) interface{}
+		want []time.Duration
+	}{
+		{
+			name: "stable",
+			fn:   func(int) interface{} { return "value" },
+			want: []time.Duration{1, 2, 4, 5, 5},
+		},
+		{
+			name: "changing",
+			fn:   func(i int) interface{} { return i },
+			want: []time.Duration{1, 1, 1, 1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithAdaptiveTTL(1*time.Millisecond, 5*time.Millisecond, func(a, b interface{}) bool {
+				return a == b
+			}))
+
+			for i, want := range tt.want {
+				dispatcher.Do("key", func() (interface{}, error) {
+					return tt.fn(i), nil
+				})
+				config, _ := dispatcher.Config("key")
+				if config.Expiration != want*time.Millisecond {
+					t.Errorf("#%d: Expiration = %v, want %v", i, config.Expiration, want*time.Millisecond)
+				}
+				time.Sleep(config.Expiration + time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestWithAllowStale(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []callcache.Option
+		want interface{}
+	}{
+		{name: "strict", want: "new"},
+		{name: "allow stale", opts: []callcache.Option{callcache.WithAllowStale(true)}, want: "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+			refreshed := make(chan struct{}, 1)
+			opts := append([]callcache.Option{
+				callcache.WithClock(clock),
+				callcache.WithRefreshDoneHook(func(string) {
+					select {
+					case refreshed <- struct{}{}:
+					default:
+					}
+				}),
+			}, tt.opts...)
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, opts...)
+			dispatcher.Do("key", func() (interface{}, error) { return "old", nil })
+			clock.Add(2 * time.Minute)
+
+			release := make(chan struct{})
+			var calls int32
+			fn := func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "new", nil
+			}
+
+			results := make(chan interface{}, 10)
+			for i := 0; i < cap(results); i++ {
+				go func() {
+					v, _ := dispatcher.Do("key", fn)
+					results <- v
+				}()
+			}
+			if tt.want == "new" {
+				// Every caller is blocked until fn returns.
+				time.Sleep(10 * time.Millisecond)
+				if n := len(results); n != 0 {
+					t.Fatalf("%d callers returned before fn, want 0", n)
+				}
+				close(release)
+			}
+			for i := 0; i < cap(results); i++ {
+				if v := <-results; v != tt.want {
+					t.Errorf("Do() = %v, want %v", v, tt.want)
+				}
+			}
+			if tt.want == "old" {
+				close(release)
+				<-refreshed
+				if v, _ := dispatcher.Do("key", fn); v != "new" {
+					t.Errorf("Do() after refresh = %v, want new", v)
+				}
+			}
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				t.Errorf("fn was called %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestWithReadOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     bool
+		elapsed time.Duration
+		want    interface{}
+		wantErr error
+	}{
+		{name: "hit", set: true, elapsed: 30 * time.Second, want: "cached"},
+		{name: "stale", set: true, elapsed: 2 * time.Minute, want: "cached"},
+		{name: "absent", elapsed: 2 * time.Minute, wantErr: callcache.ErrNotCached},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second,
+				callcache.WithClock(clock),
+				callcache.WithReadOnly(),
+			)
+			if tt.set {
+				dispatcher.Set("key", "cached")
+			}
+			clock.Add(tt.elapsed)
+
+			var calls int32
+			fn := func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				return "new", nil
+			}
+			for i := 0; i < 3; i++ {
+				if got, err := dispatcher.Do("key", fn); got != tt.want || err != tt.wantErr {
+					t.Errorf("Do() = %v, %v, want %v, %v", got, err, tt.want, tt.wantErr)
+				}
+			}
+			if got, err := dispatcher.ForceRefresh("key", callcache.IsolateRefresh, fn); got != tt.want || err != tt.wantErr {
+				t.Errorf("ForceRefresh() = %v, %v, want %v, %v", got, err, tt.want, tt.wantErr)
+			}
+			// Give a refresh in the background, if any, a chance to run.
+			time.Sleep(10 * time.Millisecond)
+			if n := atomic.LoadInt32(&calls); n != 0 {
+				t.Errorf("fn was called %d times, want 0", n)
+			}
+			if s := dispatcher.Stats(); s.Refreshes != 0 || s.Executions != 0 {
+				t.Errorf("Stats() = %+v, want no refreshes or executions", s)
+			}
+		})
+	}
+}
+
+func TestWithStartupJitter(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	refreshed := make(chan struct{}, 100)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second,
+		callcache.WithClock(clock),
+		callcache.WithStartupJitter(10*time.Second),
+		callcache.WithRefreshDoneHook(func(string) { refreshed <- struct{}{} }),
+	)
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		dispatcher.Do(strconv.Itoa(i), func() (interface{}, error) { return "warm", nil })
+	}
+
+	// Each key is refreshed once from 10s to 20s, and fn records the second
+	// at which the refresh was started.
+	var mu sync.Mutex
+	startedAt := make(map[string]int)
+	for sec := 1; sec <= 20; sec++ {
+		clock.Add(1 * time.Second)
+		for i := 0; i < n; i++ {
+			key, sec := strconv.Itoa(i), sec
+			dispatcher.Do(key, func() (interface{}, error) {
+				mu.Lock()
+				startedAt[key] = sec
+				mu.Unlock()
+				return "refreshed", nil
+			})
+		}
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-refreshed:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("%d keys were refreshed, want %d", i, n)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	seconds := make(map[int]bool)
+	for key, sec := range startedAt {
+		if sec <= 10 {
+			t.Errorf("%q was refreshed at %ds, want after 10s", key, sec)
+		}
+		seconds[sec] = true
+	}
+	if len(seconds) < 2 {
+		t.Errorf("the keys were refreshed at %v, want spread over the jitter", startedAt)
+	}
+}
+
+func TestWithStartupJitter_config(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second,
+		callcache.WithClock(clock),
+		callcache.WithStartupJitter(10*time.Second),
+	)
+	fn := func() (interface{}, error) { return "value", nil }
+
+	dispatcher.Do("pending", fn)
+	dispatcher.Do("reloaded", fn)
+	c, _ := dispatcher.Config("pending")
+	if c.StartupDelay < 0 || c.StartupDelay >= 10*time.Second {
+		t.Fatalf("StartupDelay = %v, want [0, 10s)", c.StartupDelay)
+	}
+	clock.Add(10*time.Second + c.StartupDelay)
+	if dispatcher.RefreshPending("pending") {
+		t.Error("RefreshPending() within the delay = true, want false")
+	}
+	clock.Add(1 * time.Nanosecond)
+	if !dispatcher.RefreshPending("pending") {
+		t.Error("RefreshPending() after the delay = false, want true")
+	}
+
+	// A synchronous reload of the expired result drops the delay.
+	clock.Add(1 * time.Minute)
+	dispatcher.Do("reloaded", fn)
+	if c, _ := dispatcher.Config("reloaded"); c.StartupDelay != 0 {
+		t.Errorf("StartupDelay after the reload = %v, want 0", c.StartupDelay)
+	}
+}
+
+func TestWithMapGrowthObserver(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []int
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithMapGrowthObserver(func(newSize int) {
+		mu.Lock()
+		sizes = append(sizes, newSize)
+		mu.Unlock()
+	}))
+	fn := func() (interface{}, error) { return "v", nil }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dispatcher.Do(strconv.Itoa(i), fn)
+		}(i)
+	}
+	wg.Wait()
+	if n := dispatcher.Len(); n != 100 {
+		t.Errorf("Len() = %d, want 100", n)
+	}
+
+	// Shrinking and growing again below the largest size must not be reported.
+	for i := 0; i < 100; i++ {
+		dispatcher.Remove(strconv.Itoa(i))
+	}
+	for i := 0; i < 64; i++ {
+		dispatcher.Do(strconv.Itoa(i), fn)
+	}
+
+	sort.Ints(sizes)
+	if want := []int{1, 2, 4, 8, 16, 32, 64}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("observed sizes = %v, want %v", sizes, want)
+	}
+}
+
+func TestDispatcher_LenFresh(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+	fn := func() (interface{}, error) { return "v", nil }
+
+	for i := 0; i < 3; i++ {
+		dispatcher.Do(strconv.Itoa(i), fn)
+	}
+	clock.Add(30 * time.Second)
+	for i := 3; i < 5; i++ {
+		dispatcher.Do(strconv.Itoa(i), fn)
+	}
+	dispatcher.DoUntil("pinned", clock.Now().Add(10*time.Second), fn)
+	dispatcher.Do("failed", func() (interface{}, error) { return nil, errors.New("error") })
+
+	check := func(wantLen, wantFresh int) {
+		t.Helper()
+		if n := dispatcher.Len(); n != wantLen {
+			t.Errorf("Len() = %d, want %d", n, wantLen)
+		}
+		if n := dispatcher.LenFresh(); n != wantFresh {
+			t.Errorf("LenFresh() = %d, want %d", n, wantFresh)
+		}
+	}
+	check(7, 6)
+
+	clock.Add(20 * time.Second)
+	check(7, 5)
+
+	clock.Add(20 * time.Second)
+	check(7, 2)
+
+	clock.Add(30 * time.Second)
+	check(7, 0)
+}
+
+func TestDispatcher_DoUntil(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+
+	calls := 0
+	fn := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+
+	tests := []struct {
+		elapsed    time.Duration
+		validUntil time.Duration
+		want       int
+	}{
+		{elapsed: 0, validUntil: 10 * time.Second, want: 1},
+		{elapsed: 10 * time.Second, validUntil: 2 * time.Minute, want: 1},
+		{elapsed: 10*time.Second + 1, validUntil: 2 * time.Minute, want: 2},
+		// pinned beyond the expiration of the Dispatcher
+		{elapsed: 2 * time.Minute, validUntil: 3 * time.Minute, want: 2},
+		{elapsed: 2*time.Minute + 1, validUntil: 0, want: 3},
+	}
+	for _, tt := range tests {
+		clock.now = start.Add(tt.elapsed)
+		var v interface{}
+		if tt.validUntil == 0 {
+			v, _ = dispatcher.Do("key", fn)
+		} else {
+			v, _ = dispatcher.DoUntil("key", start.Add(tt.validUntil), fn)
+		}
+		if v != tt.want {
+			t.Errorf("at %v: got %v, want %v", tt.elapsed, v, tt.want)
+		}
+	}
+
+	// A result stored by Do uses the expiration again.
+	clock.now = start.Add(2*time.Minute + 1 + time.Minute)
+	if v, _ := dispatcher.Do("key", fn); v != 3 {
+		t.Errorf("Do() within the expiration = %v, want 3", v)
+	}
+}
+
+func TestDispatcher_RefreshPending(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second, callcache.WithClock(clock))
+	if dispatcher.RefreshPending("key") {
+		t.Error("RefreshPending() for a missing key = true, want false")
+	}
+	dispatcher.Do("key", func() (interface{}, error) { return "v", nil })
+
+	tests := []struct {
+		age  time.Duration
+		want bool
+	}{
+		{age: 0, want: false},
+		{age: 10 * time.Second, want: false},
+		{age: 10*time.Second + 1, want: true},
+		{age: 1 * time.Minute, want: true},
+		{age: 1*time.Minute + 1, want: false},
+	}
+	start := clock.Now()
+	for _, tt := range tests {
+		clock.now = start.Add(tt.age)
+		if got := dispatcher.RefreshPending("key"); got != tt.want {
+			t.Errorf("RefreshPending() at %v = %v, want %v", tt.age, got, tt.want)
+		}
+	}
+}
+
+func TestWithMaxTotalAge(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	refreshed := make(chan struct{}, 1)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second,
+		callcache.WithClock(clock),
+		callcache.WithMaxTotalAge(45*time.Second),
+		callcache.WithRefreshDoneHook(func(string) { refreshed <- struct{}{} }),
+	)
+
+	var calls int32
+	fn := func() (interface{}, error) {
+		return int(atomic.AddInt32(&calls, 1)), nil
+	}
+
+	tests := []struct {
+		elapsed time.Duration
+		want    int
+		refresh bool
+	}{
+		{elapsed: 0, want: 1},
+		{elapsed: 20 * time.Second, want: 1, refresh: true},
+		{elapsed: 20 * time.Second, want: 2, refresh: true},
+		// refreshed 20 seconds ago, but first stored 45 seconds ago
+		{elapsed: 5*time.Second + 1, want: 4},
+		{elapsed: 20 * time.Second, want: 4, refresh: true},
+	}
+	for i, tt := range tests {
+		clock.Add(tt.elapsed)
+		if v, _ := dispatcher.Do("key", fn); v != tt.want {
+			t.Errorf("%d: Do() = %v, want %v", i, v, tt.want)
+		}
+		if tt.refresh {
+			<-refreshed
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Errorf("fn was called %d times, want 5", n)
+	}
+}
+
+func TestDispatcher_DoWithTimestamp(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	refreshed := make(chan struct{}, 1)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second,
+		callcache.WithClock(clock),
+		callcache.WithRefreshDoneHook(func(string) { refreshed <- struct{}{} }),
+	)
+
+	var calls int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		n := int(atomic.AddInt32(&calls, 1))
+		if n == 2 {
+			<-release
+		}
+		return n, nil
+	}
+
+	tests := []struct {
+		elapsed  time.Duration
+		want     int
+		storedAt time.Duration
+		refresh  bool
+	}{
+		{elapsed: 0, want: 1, storedAt: 0},
+		{elapsed: 5 * time.Second, want: 1, storedAt: 0},
+		// the stale result is returned with its timestamp while refreshing
+		{elapsed: 15 * time.Second, want: 1, storedAt: 0, refresh: true},
+		{elapsed: 20 * time.Second, want: 2, storedAt: 15 * time.Second},
+		{elapsed: 2 * time.Minute, want: 3, storedAt: 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		clock.now = start.Add(tt.elapsed)
+		v, storedAt, err := dispatcher.DoWithTimestamp("key", fn)
+		if tt.refresh {
+			close(release)
+			<-refreshed
+		}
+		if err != nil || v != tt.want || !storedAt.Equal(start.Add(tt.storedAt)) {
+			t.Errorf("at %v: DoWithTimestamp() = %v, %v, %v, want %v, %v, nil", tt.elapsed, v, storedAt.Sub(start), err, tt.want, tt.storedAt)
+		}
+	}
+}
+
+func TestDispatcher_DoReplace(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	switchAt := start.Add(3 * time.Minute)
+	clock := &fakeClock{now: start}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+
+	oldFn := func() (interface{}, error) { return "old", nil }
+	newFn := func() (interface{}, error) { return "new", nil }
+
+	tests := []struct {
+		elapsed time.Duration
+		want    string
+	}{
+		{elapsed: 0, want: "old"},
+		{elapsed: 3*time.Minute - 1, want: "old"},
+		// the result of oldFn is kept until it expires
+		{elapsed: 3 * time.Minute, want: "old"},
+		{elapsed: 4 * time.Minute, want: "new"},
+	}
+	for _, tt := range tests {
+		clock.now = start.Add(tt.elapsed)
+		if v, _ := dispatcher.DoReplace("key", switchAt, oldFn, newFn); v != tt.want {
+			t.Errorf("at %v: got %v, want %v", tt.elapsed, v, tt.want)
+		}
+	}
+
+	dispatcher.Remove("key")
+	clock.now = switchAt.Add(-1)
+	if v, _ := dispatcher.DoReplace("key", switchAt, oldFn, newFn); v != "old" {
+		t.Errorf("just before switchAt: got %v, want old", v)
+	}
+	dispatcher.Remove("key")
+	clock.now = switchAt
+	if v, _ := dispatcher.DoReplace("key", switchAt, oldFn, newFn); v != "new" {
+		t.Errorf("at switchAt: got %v, want new", v)
+	}
+}
+
+func TestWithRemoveAfterFailures(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var evicted []interface{}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+		callcache.WithClock(clock),
+		callcache.WithStaleOnError(),
+		callcache.WithRemoveAfterFailures(3),
+		callcache.WithOnEvict(func(key string, v interface{}, reason callcache.EvictReason) {
+			if reason != callcache.EvictFailures {
+				t.Errorf("reason = %v, want %v", reason, callcache.EvictFailures)
+			}
+			evicted = append(evicted, v)
+		}),
+	)
+	errGone := errors.New("resource is gone")
+	ok := func() (interface{}, error) { return "value", nil }
+	failing := func() (interface{}, error) { return nil, errGone }
+
+	dispatcher.Do("key", ok)
+	// A success in between resets the consecutive failures.
+	for _, fn := range []func() (interface{}, error){failing, failing, ok, failing, failing} {
+		clock.Add(2 * time.Minute)
+		dispatcher.Do("key", fn)
+	}
+	if n := dispatcher.Len(); n != 1 {
+		t.Fatalf("Len() after 2 consecutive failures = %d, want 1", n)
+	}
+
+	clock.Add(2 * time.Minute)
+	if v, err := dispatcher.Do("key", failing); v != "value" || err != errGone {
+		t.Errorf("Do() = %v, %v, want value, %v", v, err, errGone)
+	}
+	if n := dispatcher.Len(); n != 0 {
+		t.Errorf("Len() after 3 consecutive failures = %d, want 0", n)
+	}
+	if want := []interface{}{"value"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted = %v, want %v", evicted, want)
+	}
+
+	if v, err := dispatcher.Do("key", failing); v != nil || err != errGone {
+		t.Errorf("Do() after removal = %v, %v, want nil, %v", v, err, errGone)
+	}
+}
+
+func TestDispatcher_DoWithTimeout(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	slow := func() (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return "value", nil
+	}
+
+	if v, err := dispatcher.DoWithTimeout("short", 10*time.Millisecond, slow); v != nil || err != callcache.ErrTimeout {
+		t.Errorf("DoWithTimeout(short) = %v, %v, want nil, %v", v, err, callcache.ErrTimeout)
+	}
+	if v, err := dispatcher.DoWithTimeout("long", 1*time.Second, slow); v != "value" || err != nil {
+		t.Errorf("DoWithTimeout(long) = %v, %v, want value, nil", v, err)
+	}
+
+	// The timeout of the key is kept for the later executions.
+	if v, err := dispatcher.Do("short", slow); v != nil || err != callcache.ErrTimeout {
+		t.Errorf("Do(short) = %v, %v, want nil, %v", v, err, callcache.ErrTimeout)
+	}
+	if v, err := dispatcher.DoWithTimeout("short", 1*time.Second, slow); v != nil || err != callcache.ErrTimeout {
+		t.Errorf("DoWithTimeout(short) with another timeout = %v, %v, want nil, %v", v, err, callcache.ErrTimeout)
+	}
+}
+
+func TestWithMaxServeAge(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	refreshed := make(chan struct{})
+	dispatcher := callcache.NewDispatcher(1*time.Hour, 1*time.Minute,
+		callcache.WithClock(clock),
+		callcache.WithMaxServeAge(5*time.Minute),
+		callcache.WithRefreshDoneHook(func(string) { refreshed <- struct{}{} }),
+	)
+	dispatcher.Do("key", func() (interface{}, error) { return "value", nil })
+	failing := func() (interface{}, error) { return nil, errors.New("backend is down") }
+
+	for i := 0; i < 5; i++ {
+		clock.Add(1*time.Minute + 1)
+		v, err := dispatcher.Do("key", failing)
+		<-refreshed
+		wantErr := error(nil)
+		if i == 4 {
+			wantErr = callcache.ErrStale
+		}
+		if v != "value" || err != wantErr {
+			t.Errorf("Do() after %d failed refreshes = %v, %v, want value, %v", i, v, err, wantErr)
+		}
+	}
+}
+
+func TestDispatcher_DoStream(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	refreshed := make(chan struct{})
+	dispatcher := callcache.NewDispatcher(1*time.Hour, 1*time.Minute,
+		callcache.WithClock(clock),
+		callcache.WithRefreshDoneHook(func(string) { refreshed <- struct{}{} }),
+	)
+	var calls int32
+	fn := func() (interface{}, error) {
+		return int(atomic.AddInt32(&calls, 1)), nil
+	}
+
+	var values []interface{}
+	if err := dispatcher.DoStream("key", fn, func(v interface{}) {
+		values = append(values, v)
+	}); err != nil {
+		t.Fatalf("DoStream() = %v, want nil", err)
+	}
+	for i := 0; i < 2; i++ {
+		clock.Add(2 * time.Minute)
+		dispatcher.Do("key", fn)
+		<-refreshed
+	}
+
+	if want := []interface{}{1, 2, 3}; !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+}
+
+func TestWithRejectEmptyKey(t *testing.T) {
+	fn := func() (interface{}, error) { return "value", nil }
+
+	t.Run("permissive", func(t *testing.T) {
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+		if v, err := dispatcher.Do("", fn); v != "value" || err != nil {
+			t.Errorf("Do() = %v, %v, want value, nil", v, err)
+		}
+		if v, ok := dispatcher.Peek(""); v != "value" || !ok {
+			t.Errorf("Peek() = %v, %v, want value, true", v, ok)
+		}
+		dispatcher.Remove("")
+		if n := dispatcher.Len(); n != 0 {
+			t.Errorf("Len() after Remove() = %d, want 0", n)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithRejectEmptyKey(false))
+		if v, err := dispatcher.Do("", fn); v != nil || err != callcache.ErrEmptyKey {
+			t.Errorf("Do() = %v, %v, want nil, %v", v, err, callcache.ErrEmptyKey)
+		}
+		dispatcher.Set("", "value")
+		if v, ok := dispatcher.Peek(""); v != nil || ok {
+			t.Errorf("Peek() = %v, %v, want nil, false", v, ok)
+		}
+		dispatcher.Remove("")
+		if n := dispatcher.Len(); n != 0 {
+			t.Errorf("Len() = %d, want 0", n)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithRejectEmptyKey(true))
+		methods := map[string]func(){
+			"Do":             func() { dispatcher.Do("", fn) },
+			"Peek":           func() { dispatcher.Peek("") },
+			"Waiters":        func() { dispatcher.Waiters("") },
+			"RefreshPending": func() { dispatcher.RefreshPending("") },
+			"Config":         func() { dispatcher.Config("") },
+			"DebugInfo":      func() { dispatcher.DebugInfo("") },
+			"Errors":         func() { dispatcher.Errors("") },
+			"History":        func() { dispatcher.History("") },
+			"MayContain":     func() { dispatcher.MayContain("") },
+		}
+		for name, method := range methods {
+			func() {
+				defer func() {
+					if r := recover(); r != callcache.ErrEmptyKey {
+						t.Errorf("recover() from %s() = %v, want %v", name, r, callcache.ErrEmptyKey)
+					}
+				}()
+				method()
+			}()
+		}
+	})
+}
+
+func TestDispatcher_Expire(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []callcache.Option
+		want interface{}
+	}{
+		{name: "strict", want: "new"},
+		{name: "allow stale", opts: []callcache.Option{callcache.WithAllowStale(true)}, want: "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refreshed := make(chan struct{}, 1)
+			opts := append([]callcache.Option{
+				callcache.WithRefreshDoneHook(func(string) { refreshed <- struct{}{} }),
+			}, tt.opts...)
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, opts...)
+			dispatcher.Set("key", "old")
+			dispatcher.Expire("key")
+			dispatcher.Expire("missing")
+
+			if v, ok := dispatcher.Peek("key"); ok {
+				t.Errorf("Peek() after Expire() = %v, %v, want nil, false", v, ok)
+			}
+			fn := func() (interface{}, error) { return "new", nil }
+			if v, _ := dispatcher.Do("key", fn); v != tt.want {
+				t.Errorf("Do() after Expire() = %v, want %v", v, tt.want)
+			}
+			if tt.want == "old" {
+				<-refreshed
+			}
+			if v, _ := dispatcher.Do("key", fn); v != "new" {
+				t.Errorf("Do() after refresh = %v, want new", v)
+			}
+			if n := dispatcher.Len(); n != 1 {
+				t.Errorf("Len() = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestWithErrorHistory(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock), callcache.WithErrorHistory(3))
+	if records := dispatcher.Errors("key"); records != nil {
+		t.Errorf("Errors() of a missing key = %v, want nil", records)
+	}
+
+	var errs []error
+	for i := 0; i < 5; i++ {
+		err := errors.New("failure " + strconv.Itoa(i))
+		errs = append(errs, err)
+		dispatcher.Do("key", func() (interface{}, error) { return nil, err })
+		clock.Add(1 * time.Second)
+	}
+
+	records := dispatcher.Errors("key")
+	if len(records) != 3 {
+		t.Fatalf("len(Errors()) = %d, want 3", len(records))
+	}
+	for i, r := range records {
+		if want := errs[i+2]; r.Err != want {
+			t.Errorf("Errors()[%d].Err = %v, want %v", i, r.Err, want)
+		}
+		if i > 0 && r.At.Sub(records[i-1].At) != 1*time.Second {
+			t.Errorf("Errors()[%d].At = %v, want 1s after %v", i, r.At, records[i-1].At)
+		}
+	}
+}
+
+func TestWithMaxConcurrentLoads(t *testing.T) {
+	t.Run("no limit", func(t *testing.T) {
+		for _, n := range []int{0, -1} {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithMaxConcurrentLoads(n, false))
+			if v, err := dispatcher.Do("key", func() (interface{}, error) { return "value", nil }); v != "value" || err != nil {
+				t.Errorf("Do() with n = %d: %v, %v, want value, nil", n, v, err)
+			}
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithMaxConcurrentLoads(3, false))
+		var running, maxRunning int32
+		fn := func() (interface{}, error) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return "value", nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if v, err := dispatcher.Do(strconv.Itoa(i), fn); v != "value" || err != nil {
+					t.Errorf("Do() = %v, %v, want value, nil", v, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if n := atomic.LoadInt32(&maxRunning); n != 3 {
+			t.Errorf("at most %d fn ran concurrently, want 3", n)
+		}
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithMaxConcurrentLoads(1, true))
+		started := make(chan struct{})
+		release := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			dispatcher.Do("slow", func() (interface{}, error) {
+				close(started)
+				<-release
+				return "value", nil
+			})
+		}()
+		<-started
+
+		fn := func() (interface{}, error) { return "value", nil }
+		if v, err := dispatcher.Do("other", fn); v != nil || err != callcache.ErrTooManyLoads {
+			t.Errorf("Do() at the limit = %v, %v, want nil, %v", v, err, callcache.ErrTooManyLoads)
+		}
+		close(release)
+		<-done
+		if v, err := dispatcher.Do("other", fn); v != "value" || err != nil {
+			t.Errorf("Do() after the release = %v, %v, want value, nil", v, err)
+		}
+	})
+}
+
+func TestDispatcher_Waiters(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	release := make(chan struct{})
+	var calls int32
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "value", nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatcher.Do("key", fn)
+		}()
+	}
+	deadline := time.Now().Add(1 * time.Second)
+	for dispatcher.Waiters("key") != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Waiters() = %d, want %d", dispatcher.Waiters("key"), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if w := dispatcher.Waiters("key"); w != 0 {
+		t.Errorf("Waiters() after the result = %d, want 0", w)
+	}
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Errorf("fn was called %d times, want 1", c)
+	}
+}
+
+func TestDispatcher_Close(t *testing.T) {
+	evicted := make(chan string, 1)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second,
+		callcache.WithMaxEntries(1),
+		callcache.WithOnEvict(func(key string, _ interface{}, _ callcache.EvictReason) {
+			evicted <- key
+		}),
+	)
+	fn := func() (interface{}, error) { return "value", nil }
+	dispatcher.Do("cached", fn)
+	dispatcher.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if v, err := dispatcher.Do("cached", fn); v != nil || !errors.Is(err, callcache.ErrClosed) {
+				t.Errorf("Do(cached) after Close() = %v, %v, want nil, %v", v, err, callcache.ErrClosed)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			_, err := dispatcher.DoWithTimeout(strconv.Itoa(i), time.Second, func() (interface{}, error) {
+				t.Error("fn was called after Close()")
+				return nil, nil
+			})
+			if !errors.Is(err, callcache.ErrClosed) {
+				t.Errorf("DoWithTimeout() after Close() error = %v, want %v", err, callcache.ErrClosed)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if v, err := dispatcher.DoCached("cached"); v != nil || !errors.Is(err, callcache.ErrClosed) {
+		t.Errorf("DoCached() after Close() = %v, %v, want nil, %v", v, err, callcache.ErrClosed)
+	}
+
+	called := make(chan struct{}, 1)
+	if v := dispatcher.DoOrDefault("missing", "default", func() (interface{}, error) {
+		called <- struct{}{}
+		return "value", nil
+	}); v != "default" {
+		t.Errorf("DoOrDefault() after Close() = %v, want default", v)
+	}
+	select {
+	case <-called:
+		t.Error("fn of DoOrDefault was called after Close()")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// No key is added after Close, so none is evicted for them.
+	select {
+	case key := <-evicted:
+		t.Errorf("%s was evicted after Close()", key)
+	default:
+	}
+	if keys := dispatcher.Keys(); len(keys) != 1 || keys[0] != "cached" {
+		t.Errorf("Keys() after Close() = %v, want [cached]", keys)
+	}
+	if v, ok := dispatcher.Peek("cached"); !ok || v != "value" {
+		t.Errorf("Peek() after Close() = %v, %v, want value, true", v, ok)
+	}
+}
+
+func TestDispatcher_Bump(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	calls := make(map[string]int)
+	fn := func(key string) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			calls[key]++
+			return calls[key], nil
+		}
+	}
+	keys := []string{"a", "b", "c"}
+
+	for _, key := range keys {
+		dispatcher.Do(key, fn(key))
+	}
+	dispatcher.Bump()
+	for _, key := range keys {
+		if _, ok := dispatcher.Peek(key); ok {
+			t.Errorf("Peek(%s) after Bump() = true, want false", key)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		for _, key := range keys {
+			if v, _ := dispatcher.Do(key, fn(key)); v != 2 {
+				t.Errorf("Do(%s) after Bump() = %v, want 2", key, v)
+			}
+		}
+	}
+	if n := dispatcher.Len(); n != len(keys) {
+		t.Errorf("Len() = %d, want %d", n, len(keys))
+	}
+}
+
+func TestWithRemoveTombstone(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       []callcache.Option
+		remove     func(d *callcache.Dispatcher, h callcache.Handle)
+		resurrects bool
+	}{
+		{name: "default", resurrects: true},
+		{name: "tombstone", opts: []callcache.Option{callcache.WithRemoveTombstone(1 * time.Minute)}, resurrects: false},
+		{
+			name:   "tombstone by Handle.Remove",
+			opts:   []callcache.Option{callcache.WithRemoveTombstone(1 * time.Minute)},
+			remove: func(_ *callcache.Dispatcher, h callcache.Handle) { h.Remove() },
+		},
+		{
+			name:   "tombstone by InvalidateTag",
+			opts:   []callcache.Option{callcache.WithRemoveTombstone(1 * time.Minute)},
+			remove: func(d *callcache.Dispatcher, _ callcache.Handle) { d.InvalidateTag("tag") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+			dispatcher := callcache.NewDispatcher(1*time.Hour, 0, append(tt.opts, callcache.WithClock(clock))...)
+			seed := func() (interface{}, error) { return "seed", nil }
+			h, _ := dispatcher.DoHandle("key", seed)
+			dispatcher.DoTagged("key", []string{"tag"}, seed)
+			dispatcher.Expire("key")
+
+			// An in-flight execution reads the state before the removal.
+			started := make(chan struct{})
+			release := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				dispatcher.DoShared("key", "shared", func() (interface{}, error) {
+					close(started)
+					<-release
+					return "old", nil
+				})
+			}()
+			<-started
+			if tt.remove != nil {
+				tt.remove(dispatcher, h)
+			} else {
+				dispatcher.Remove("key")
+			}
+
+			// A new call after the removal joins the in-flight execution.
+			joined := make(chan interface{})
+			go func() {
+				v, _ := dispatcher.DoShared("key", "shared", func() (interface{}, error) {
+					return "new", nil
+				})
+				joined <- v
+			}()
+			for dispatcher.Waiters("key") == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			// Give it time to reach the shared execution.
+			time.Sleep(10 * time.Millisecond)
+			close(release)
+			<-done
+			if v := <-joined; v != "old" {
+				t.Fatalf("DoShared() = %v, want old from the shared execution", v)
+			}
+
+			if _, ok := dispatcher.Peek("key"); ok != tt.resurrects {
+				t.Errorf("Peek() after Remove() = %v, want %v", ok, tt.resurrects)
+			}
+
+			clock.Add(2 * time.Minute)
+			dispatcher.Do("key", func() (interface{}, error) { return "new", nil })
+			if _, ok := dispatcher.Peek("key"); !ok {
+				t.Error("Peek() after the grace period = false, want true")
+			}
+		})
+	}
+}
+
+func TestWithKeyValidator(t *testing.T) {
+	format := regexp.MustCompile(`^[a-z]+:[0-9]+$`)
+	errFormat := errors.New("must be <kind>:<id>")
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithKeyValidator(func(key string) error {
+		if !format.MatchString(key) {
+			return errFormat
+		}
+		return nil
+	}))
+	fn := func() (interface{}, error) { return "value", nil }
+
+	for _, key := range []string{"user:1", "order:42"} {
+		if v, err := dispatcher.Do(key, fn); v != "value" || err != nil {
+			t.Errorf("Do(%q) = %v, %v, want value, nil", key, v, err)
+		}
+	}
+	for _, key := range []string{"", "user", "user:abc", "User:1"} {
+		v, err := dispatcher.Do(key, fn)
+		if v != nil || !errors.Is(err, callcache.ErrInvalidKey) || !strings.Contains(err.Error(), errFormat.Error()) {
+			t.Errorf("Do(%q) = %v, %v, want nil, %v", key, v, err, callcache.ErrInvalidKey)
+		}
+		dispatcher.Set(key, "value")
+	}
+	if n := dispatcher.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+}
+
+func TestWithMinRefreshInterval(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Nanosecond, 0,
+		callcache.WithClock(clock),
+		callcache.WithMinRefreshInterval(1*time.Second),
+	)
+	var calls int32
+	fn := func() (interface{}, error) {
+		return int(atomic.AddInt32(&calls, 1)), nil
+	}
+
+	const seconds = 5
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if v, err := dispatcher.Do("key", fn); err != nil && err != callcache.ErrRateLimited {
+					t.Errorf("Do() = %v, %v", v, err)
+				}
+				if i == 0 && j%100 == 99 {
+					clock.Add(1 * time.Second)
+				}
+				if i == 1 && j%10 == 0 {
+					dispatcher.Remove("key")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// one execution per second from the start, including the last second
+	if n := atomic.LoadInt32(&calls); n > seconds+1 {
+		t.Errorf("fn was called %d times in %d seconds, want at most %d", n, seconds, seconds+1)
+	}
+}
+
+func TestWithHistory(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock), callcache.WithHistory(3))
+	if h := dispatcher.History("key"); h != nil {
+		t.Errorf("History() of a missing key = %v, want nil", h)
+	}
+
+	for i := 1; i <= 5; i++ {
+		dispatcher.Do("key", func() (interface{}, error) { return i, nil })
+		clock.Add(2 * time.Minute)
+	}
+
+	history := dispatcher.History("key")
+	var values []interface{}
+	for _, e := range history {
+		values = append(values, e.Value)
+	}
+	if want := []interface{}{3, 4, 5}; !reflect.DeepEqual(values, want) {
+		t.Errorf("values of History() = %v, want %v", values, want)
+	}
+	if d := history[2].At.Sub(history[1].At); d != 2*time.Minute {
+		t.Errorf("interval of History() = %v, want 2m", d)
+	}
+}
+
+func TestWithMaxConcurrentRefreshes_noLimit(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+		refreshed := make(chan string, 1)
+		dispatcher := callcache.NewDispatcher(1*time.Hour, 1*time.Minute,
+			callcache.WithClock(clock),
+			callcache.WithMaxConcurrentRefreshes(n),
+			callcache.WithRefreshDoneHook(func(key string) { refreshed <- key }),
+		)
+		fn := func() (interface{}, error) { return "value", nil }
+		dispatcher.Do("key", fn)
+
+		for i := 0; i < 3; i++ {
+			clock.Add(2 * time.Minute)
+			dispatcher.Do("key", fn)
+			select {
+			case <-refreshed:
+			case <-time.After(1 * time.Second):
+				t.Fatalf("refresh %d with n = %d was not done", i, n)
+			}
+		}
+	}
+}
+
+func TestWithMaxConcurrentRefreshes(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	refreshed := make(chan string, 3)
+	dispatcher := callcache.NewDispatcher(1*time.Hour, 1*time.Minute,
+		callcache.WithClock(clock),
+		callcache.WithMaxConcurrentRefreshes(1),
+		callcache.WithRefreshDoneHook(func(key string) { refreshed <- key }),
+	)
+	fn := func() (interface{}, error) { return "value", nil }
+	dispatcher.Do("busy", fn)
+	dispatcher.DoUntil("far", start.Add(50*time.Minute), fn)
+	dispatcher.DoUntil("near", start.Add(3*time.Minute), fn)
+	clock.Add(2 * time.Minute)
+
+	// Occupy the only slot so that the others are queued.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	dispatcher.Do("busy", func() (interface{}, error) {
+		close(started)
+		<-release
+		return "value", nil
+	})
+	<-started
+
+	var mu sync.Mutex
+	var order []string
+	record := func(key string) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			mu.Lock()
+			order = append(order, key)
+			mu.Unlock()
+			return "value", nil
+		}
+	}
+	dispatcher.Do("far", record("far"))
+	dispatcher.Do("near", record("near"))
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-refreshed
+	}
+
+	if want := []string{"near", "far"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("refreshed in %v, want %v", order, want)
+	}
+}
@@ -0,0 +1,49 @@
+package callcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// cardinalityWindow is the period over which WithCardinalityWarning
+	// measures the rate of new keys.
+	cardinalityWindow = 10 * time.Second
+	// cardinalityHitRatio is the hit ratio below which the keys are
+	// considered never reused.
+	cardinalityHitRatio = 0.01
+)
+
+// cardinality holds the counters of WithCardinalityWarning. All fields are
+// accessed atomically.
+type cardinality struct {
+	windowStart int64
+	created     int64
+	hitsBase    int64
+}
+
+// checkCardinality counts a new key and, once the window has elapsed, calls
+// the function set by WithCardinalityWarning if the keys were created faster
+// than the minimum rate while hardly any of them were hit.
+func (d *Dispatcher) checkCardinality() {
+	k := &d.cardinality
+	atomic.AddInt64(&k.created, 1)
+
+	now := d.sinceEpoch(d.clock.Now())
+	start := atomic.LoadInt64(&k.windowStart)
+	if now-start < int64(cardinalityWindow) || !atomic.CompareAndSwapInt64(&k.windowStart, start, now) {
+		return
+	}
+
+	created := atomic.SwapInt64(&k.created, 0)
+	total := atomic.LoadInt64(&d.stats.hits)
+	hits := total - atomic.SwapInt64(&k.hitsBase, total)
+	if hits < 0 {
+		// ResetStats was called in the window.
+		hits = 0
+	}
+	rate := float64(created) / time.Duration(now-start).Seconds()
+	if rate >= d.cardinalityRate && float64(hits) < cardinalityHitRatio*float64(hits+created) {
+		d.cardinalityFn(rate)
+	}
+}
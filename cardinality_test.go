@@ -0,0 +1,45 @@
+package callcache_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithCardinalityWarning(t *testing.T) {
+	tests := []struct {
+		name string
+		key  func(i int) string
+		want bool
+	}{
+		{name: "unique keys", key: strconv.Itoa, want: true},
+		{name: "reused keys", key: func(i int) string { return strconv.Itoa(i % 10) }, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+			var rates []float64
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+				callcache.WithClock(clock),
+				callcache.WithCardinalityWarning(100, func(ratePerSec float64) {
+					rates = append(rates, ratePerSec)
+				}),
+			)
+			fn := func() (interface{}, error) { return "value", nil }
+
+			// 200 calls per second for 11 seconds
+			for i := 0; i < 2200; i++ {
+				dispatcher.Do(tt.key(i), fn)
+				clock.Add(5 * time.Millisecond)
+			}
+			if got := len(rates) > 0; got != tt.want {
+				t.Fatalf("warned = %v (%v), want %v", got, rates, tt.want)
+			}
+			if tt.want && (rates[0] < 190 || rates[0] > 210) {
+				t.Errorf("rate = %v, want about 200", rates[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+// Package cctest provides utilities for testing code that uses callcache.
+package cctest
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+// Clock is a callcache.Clock whose time only moves by Advance.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock creates a new Clock starting at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the current time of c.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the time of c forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// refreshes counts the completed refreshes of each key of a Dispatcher.
+type refreshes struct {
+	mu   sync.Mutex
+	done map[string]int
+	// changed is closed and replaced each time a refresh completes.
+	changed chan struct{}
+}
+
+var (
+	trackedMu sync.Mutex
+	tracked   = make(map[*callcache.Dispatcher]*refreshes)
+)
+
+// TrackRefreshes returns an Option that makes WaitForRefresh available for the
+// Dispatcher until t finishes. It sets the hook of
+// callcache.WithRefreshDoneHook, so a hook to be called as well must be given
+// as hook instead, which can be nil. callcache.WithRefreshDoneHook given after
+// it disables the tracking.
+func TrackRefreshes(t testing.TB, hook func(key string)) callcache.Option {
+	return func(d *callcache.Dispatcher) {
+		r := &refreshes{done: make(map[string]int), changed: make(chan struct{})}
+		trackedMu.Lock()
+		tracked[d] = r
+		trackedMu.Unlock()
+		t.Cleanup(func() {
+			trackedMu.Lock()
+			delete(tracked, d)
+			trackedMu.Unlock()
+		})
+
+		callcache.WithRefreshDoneHook(func(key string) {
+			if hook != nil {
+				hook(key)
+			}
+			r.mu.Lock()
+			r.done[key]++
+			close(r.changed)
+			r.changed = make(chan struct{})
+			r.mu.Unlock()
+		})(d)
+	}
+}
+
+// WaitForRefresh waits until a refresh of the given key in the background
+// completes, and fails t if it does not within timeout. Each completed refresh
+// satisfies only one call of WaitForRefresh, so a refresh that completed before
+// the call is not missed. With callcache.WithKeyHasher or
+// callcache.WithContextKeyExtractor, key must be the one stored in d as
+// returned by Keys. d must be created with TrackRefreshes.
+func WaitForRefresh(t testing.TB, d *callcache.Dispatcher, key string, timeout time.Duration) {
+	t.Helper()
+	trackedMu.Lock()
+	r := tracked[d]
+	trackedMu.Unlock()
+	if r == nil {
+		t.Fatal("cctest: Dispatcher is not created with TrackRefreshes")
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.mu.Lock()
+		if r.done[key] > 0 {
+			r.done[key]--
+			r.mu.Unlock()
+			return
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			t.Fatalf("cctest: %s was not refreshed within %v", key, timeout)
+			return
+		}
+	}
+}
+
+// AssertCached reports an error to t unless the valid execution result of the
+// given key in d is deeply equal to want.
+func AssertCached(t testing.TB, d *callcache.Dispatcher, key string, want interface{}) {
+	t.Helper()
+	v, ok := d.Peek(key)
+	if !ok {
+		t.Errorf("%s is not cached, want %v", key, want)
+		return
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("%s is cached as %v, want %v", key, v, want)
+	}
+}
+
+// AssertNotCached reports an error to t if there is a valid execution result
+// of the given key in d.
+func AssertNotCached(t testing.TB, d *callcache.Dispatcher, key string) {
+	t.Helper()
+	if v, ok := d.Peek(key); ok {
+		t.Errorf("%s is cached as %v, want not cached", key, v)
+	}
+}
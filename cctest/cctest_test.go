@@ -0,0 +1,77 @@
+package cctest_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+	"github.com/daisuzu/callcache/cctest"
+)
+
+func TestClock_expiration(t *testing.T) {
+	clock := cctest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+	dispatcher.Set("key", "value")
+
+	clock.Advance(1 * time.Minute)
+	cctest.AssertCached(t, dispatcher, "key", "value")
+
+	clock.Advance(1)
+	cctest.AssertNotCached(t, dispatcher, "key")
+}
+
+func TestWaitForRefresh(t *testing.T) {
+	clock := cctest.NewClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	var hooked []string
+	dispatcher := callcache.NewDispatcher(1*time.Hour, 1*time.Minute, callcache.WithClock(clock), cctest.TrackRefreshes(t, func(key string) {
+		hooked = append(hooked, key)
+	}))
+	calls := 0
+	fn := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+
+	dispatcher.Do("key", fn)
+	for i := 2; i <= 3; i++ {
+		clock.Advance(2 * time.Minute)
+		if v, _ := dispatcher.Do("key", fn); v != i-1 {
+			t.Errorf("Do() = %v, want the previous result %d", v, i-1)
+		}
+		cctest.WaitForRefresh(t, dispatcher, "key", 1*time.Second)
+		cctest.AssertCached(t, dispatcher, "key", i)
+	}
+	if len(hooked) != 2 {
+		t.Errorf("hook was called %d times, want 2", len(hooked))
+	}
+}
+
+func TestWaitForRefresh_timeout(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Hour, 0, cctest.TrackRefreshes(t, nil))
+	dispatcher.Set("key", "value")
+
+	ft := &fakeTB{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cctest.WaitForRefresh(ft, dispatcher, "key", 10*time.Millisecond)
+	}()
+	<-done
+	if !ft.failed {
+		t.Error("WaitForRefresh() did not fail without a refresh")
+	}
+}
+
+// fakeTB records a failure instead of failing the test.
+type fakeTB struct {
+	testing.TB
+	failed bool
+}
+
+func (tb *fakeTB) Helper() {}
+
+func (tb *fakeTB) Fatalf(format string, args ...interface{}) {
+	tb.failed = true
+	runtime.Goexit()
+}
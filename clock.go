@@ -0,0 +1,31 @@
+package callcache
+
+import "time"
+
+// Clock provides the current time to a Dispatcher.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// doAt is like Do, but the freshness of the result is decided at now instead of
+// the current time of the clock, which is also the time the result is stored
+// at, so that the tests can drive a key at exact instants.
+func (d *Dispatcher) doAt(key string, now time.Time, fn func() (interface{}, error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	return d.call(key).do(work{fn: fn, at: now})
+}
+
+// sinceEpoch returns the elapsed nanoseconds from the creation of d to t, which
+// can be stored atomically. As long as t is from the system clock, it is
+// measured with the monotonic clock.
+func (d *Dispatcher) sinceEpoch(t time.Time) int64 {
+	return int64(t.Sub(d.epoch))
+}
@@ -0,0 +1,57 @@
+package callcache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatcher_doAt(t *testing.T) {
+	t0 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	refreshed := make(chan struct{}, 1)
+	d := NewDispatcher(1*time.Minute, 0, WithRefreshDoneHook(func(string) {
+		refreshed <- struct{}{}
+	}))
+
+	var calls int32
+	fn := func() (interface{}, error) {
+		return int(atomic.AddInt32(&calls, 1)), nil
+	}
+
+	tests := []struct {
+		key string
+		// interval is the updateInterval of the key when it is created.
+		interval time.Duration
+		at       time.Time
+		want     int
+		refresh  bool
+	}{
+		{key: "expiration", at: t0, want: 1},
+		// The result expires after the expiration from the instant it
+		// is stored at.
+		{key: "expiration", at: t0.Add(1 * time.Minute), want: 1},
+		{key: "expiration", at: t0.Add(1*time.Minute + 1), want: 2},
+		{key: "expiration", at: t0.Add(2*time.Minute + 1), want: 2},
+		{key: "expiration", at: t0.Add(2*time.Minute + 2), want: 3},
+
+		{key: "refresh", interval: 10 * time.Second, at: t0, want: 4},
+		{key: "refresh", interval: 10 * time.Second, at: t0.Add(10 * time.Second), want: 4},
+		{key: "refresh", interval: 10 * time.Second, at: t0.Add(10*time.Second + 1), want: 4, refresh: true},
+		{key: "refresh", interval: 10 * time.Second, at: t0.Add(20*time.Second + 1), want: 5},
+	}
+	for i, tt := range tests {
+		d.SetUpdateInterval(tt.interval)
+		v, err := d.doAt(tt.key, tt.at, fn)
+		if err != nil || v != tt.want {
+			t.Errorf("#%d: doAt(%s, %v) = %v, %v, want %d, nil", i, tt.key, tt.at, v, err, tt.want)
+		}
+		if tt.refresh {
+			<-refreshed
+		}
+		select {
+		case <-refreshed:
+			t.Errorf("#%d: doAt(%s, %v) refreshed the result", i, tt.key, tt.at)
+		default:
+		}
+	}
+}
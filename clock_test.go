@@ -0,0 +1,55 @@
+package callcache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestWithClock_backwards(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+
+	var calls int
+	fn := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+
+	steps := []struct {
+		step time.Duration
+		want int
+	}{
+		{step: 0, want: 1},
+		{step: 30 * time.Second, want: 1},
+		// The result updated in the future is not trusted.
+		{step: -1 * time.Hour, want: 2},
+		{step: 30 * time.Second, want: 2},
+		{step: 31 * time.Second, want: 3},
+	}
+	for i, s := range steps {
+		clock.Add(s.step)
+		if v, _ := dispatcher.Do("key", fn); v != s.want {
+			t.Errorf("#%d: Do() = %v, want %v", i, v, s.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package callcache
+
+// DoConditional is like Do, but fn receives the token it returned along with
+// the current execution result, such as an ETag, to tell whether the result
+// has been modified since then. If fn reports notModified, the current result
+// is kept and just treated as updated, so the value fn returns is ignored, and
+// so is the token if it is empty.
+// prevToken is empty on the first execution, or if the token has been lost by
+// removing the key.
+func (d *Dispatcher) DoConditional(key string, fn func(prevToken string) (v interface{}, token string, notModified bool, err error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	c := d.call(key)
+	return c.do(work{fn: func() (interface{}, error) {
+		c.mu.RLock()
+		prevToken := c.token
+		prev, ok := c.value()
+		c.mu.RUnlock()
+
+		v, token, notModified, err := fn(prevToken)
+		if err != nil {
+			return v, err
+		}
+		kept := notModified && ok
+		if kept {
+			v = prev
+			if token == "" {
+				token = prevToken
+			}
+		}
+		// The token is stored by execute only if v is cached, so that it never
+		// refers to a value that was not.
+		return annotated{v: v, token: token, hasToken: true, transformed: kept}, nil
+	}})
+}
@@ -0,0 +1,116 @@
+package callcache_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_DoConditional(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+
+	type response struct {
+		v           interface{}
+		token       string
+		notModified bool
+	}
+	tests := []struct {
+		name      string
+		elapsed   time.Duration
+		response  response
+		prevToken string
+		want      interface{}
+		storedAt  time.Duration
+	}{
+		{
+			name:     "first load",
+			response: response{v: "v1", token: "t1"},
+			want:     "v1",
+		},
+		{
+			name:      "not modified",
+			elapsed:   2 * time.Minute,
+			response:  response{notModified: true},
+			prevToken: "t1",
+			want:      "v1",
+			storedAt:  2 * time.Minute,
+		},
+		{
+			name:      "modified",
+			elapsed:   4 * time.Minute,
+			response:  response{v: "v2", token: "t2"},
+			prevToken: "t1",
+			want:      "v2",
+			storedAt:  4 * time.Minute,
+		},
+		{
+			name:      "not modified with a new token",
+			elapsed:   6 * time.Minute,
+			response:  response{v: "ignored", token: "t3", notModified: true},
+			prevToken: "t2",
+			want:      "v2",
+			storedAt:  6 * time.Minute,
+		},
+		{
+			name:      "after the new token",
+			elapsed:   8 * time.Minute,
+			response:  response{notModified: true},
+			prevToken: "t3",
+			want:      "v2",
+			storedAt:  8 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		clock.now = start.Add(tt.elapsed)
+		v, err := dispatcher.DoConditional("key", func(prevToken string) (interface{}, string, bool, error) {
+			if prevToken != tt.prevToken {
+				t.Errorf("%s: prevToken = %q, want %q", tt.name, prevToken, tt.prevToken)
+			}
+			return tt.response.v, tt.response.token, tt.response.notModified, nil
+		})
+		if err != nil || v != tt.want {
+			t.Errorf("%s: DoConditional() = %v, %v, want %v, nil", tt.name, v, err, tt.want)
+		}
+		if _, storedAt, _ := dispatcher.DoWithTimestamp("key", nil); !storedAt.Equal(start.Add(tt.storedAt)) {
+			t.Errorf("%s: stored at %v, want %v", tt.name, storedAt.Sub(start), tt.storedAt)
+		}
+	}
+}
+
+func TestDispatcher_DoConditional_notCached(t *testing.T) {
+	errRejected := errors.New("rejected")
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+		callcache.WithClock(clock),
+		callcache.WithResultValidator(func(key string, v interface{}) error {
+			if v == "v2" {
+				return errRejected
+			}
+			return nil
+		}),
+	)
+
+	responses := []struct {
+		v     string
+		token string
+	}{{"v1", "t1"}, {"v2", "t2"}, {"v3", "t3"}}
+	var prevTokens []string
+	for _, r := range responses {
+		r := r
+		dispatcher.DoConditional("key", func(prevToken string) (interface{}, string, bool, error) {
+			prevTokens = append(prevTokens, prevToken)
+			return r.v, r.token, false, nil
+		})
+		clock.Add(2 * time.Minute)
+	}
+
+	// The token of the rejected v2 must not be sent, since v1 is still cached.
+	if want := []string{"", "t1", "t1"}; !reflect.DeepEqual(prevTokens, want) {
+		t.Errorf("prevTokens = %q, want %q", prevTokens, want)
+	}
+}
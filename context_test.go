@@ -0,0 +1,298 @@
+package callcache_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithDiscardOnCancel(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []callcache.Option
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "default", wantErr: nil, wantCalls: 1},
+		{name: "discard", opts: []callcache.Option{callcache.WithDiscardOnCancel()}, wantErr: context.Canceled, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, tt.opts...)
+
+			var calls int
+			ctx, cancel := context.WithCancel(context.Background())
+			_, err := dispatcher.DoContext(ctx, "key", func(ctx context.Context) (interface{}, error) {
+				calls++
+				cancel()
+				return "partial", nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("DoContext() error = %v, want %v", err, tt.wantErr)
+			}
+
+			v, err := dispatcher.DoContext(context.Background(), "key", func(ctx context.Context) (interface{}, error) {
+				calls++
+				return "complete", nil
+			})
+			if err != nil || calls != tt.wantCalls {
+				t.Errorf("DoContext() = %v, %v with %d calls, want <nil> with %d calls", v, err, calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+type ctxKey struct{}
+
+func TestDispatcher_DoContext_background(t *testing.T) {
+	refreshed := make(chan string, 1)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 1*time.Nanosecond,
+		callcache.WithDiscardOnCancel(),
+		callcache.WithRefreshDoneHook(func(key string) {
+			refreshed <- key
+		}),
+	)
+
+	type observed struct {
+		err   error
+		value interface{}
+	}
+	contexts := make(chan observed, 2)
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		if ctx.Value(ctxKey{}) != nil {
+			<-canceled
+		}
+		contexts <- observed{err: ctx.Err(), value: ctx.Value(ctxKey{})}
+		return "value", nil
+	}
+
+	dispatcher.DoContext(context.Background(), "key", fn)
+	<-contexts
+	time.Sleep(1 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "request"))
+	dispatcher.DoContext(ctx, "key", fn)
+	cancel()
+	close(canceled)
+	<-refreshed
+
+	if got := <-contexts; got.err != nil || got.value != "request" {
+		t.Errorf("background fn got ctx with %v and %v, want <nil> and request", got.err, got.value)
+	}
+}
+
+type localeKey struct{}
+
+func TestWithContextKeyExtractor(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithContextKeyExtractor(func(ctx context.Context) string {
+		locale, _ := ctx.Value(localeKey{}).(string)
+		return locale
+	}))
+	calls := 0
+	fn := func(ctx context.Context) (interface{}, error) {
+		calls++
+		return "greeting in " + ctx.Value(localeKey{}).(string), nil
+	}
+
+	en := context.WithValue(context.Background(), localeKey{}, "en")
+	fr := context.WithValue(context.Background(), localeKey{}, "fr")
+	for i := 0; i < 2; i++ {
+		if v, _ := dispatcher.DoContext(en, "greeting", fn); v != "greeting in en" {
+			t.Errorf("DoContext(en) = %v, want greeting in en", v)
+		}
+		if v, _ := dispatcher.DoContext(fr, "greeting", fn); v != "greeting in fr" {
+			t.Errorf("DoContext(fr) = %v, want greeting in fr", v)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("fn was called %d times, want 2", calls)
+	}
+}
+
+func TestDispatcher_DoContext_deadline(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Nanosecond, 0)
+	dispatcher.Set("key", "stale")
+	time.Sleep(1 * time.Millisecond)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+	fn := func(ctx context.Context) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return "fresh", ctx.Err()
+	}
+
+	leader := make(chan interface{})
+	go func() {
+		v, _ := dispatcher.DoContext(context.Background(), "key", fn)
+		leader <- v
+	}()
+	<-started
+
+	type result struct {
+		v       interface{}
+		err     error
+		elapsed time.Duration
+	}
+	timeouts := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}
+	results := make([]chan result, len(timeouts))
+	for i, timeout := range timeouts {
+		results[i] = make(chan result, 1)
+		go func(ch chan result, timeout time.Duration) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			v, err := dispatcher.DoContext(ctx, "key", fn)
+			ch <- result{v: v, err: err, elapsed: time.Since(start)}
+		}(results[i], timeout)
+	}
+	for i, ch := range results {
+		r := <-ch
+		if r.v != "stale" || r.err != context.DeadlineExceeded {
+			t.Errorf("callers[%d] got %v, %v, want stale, %v", i, r.v, r.err, context.DeadlineExceeded)
+		}
+		if r.elapsed > timeouts[i]+500*time.Millisecond {
+			t.Errorf("callers[%d] returned after %v, want about %v", i, r.elapsed, timeouts[i])
+		}
+	}
+
+	close(release)
+	if v := <-leader; v != "fresh" {
+		t.Errorf("leader got %v, want fresh", v)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("fn was called %d times, want 1", n)
+	}
+}
+
+func TestDispatcher_DoWithContextTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := func(ctx context.Context) (interface{}, error) {
+		if err := ctx.Err(); err != nil {
+			t.Errorf("ctx of fn is done: %v", err)
+		}
+		<-release
+		return "new", nil
+	}
+	fast := func(context.Context) (interface{}, error) {
+		return "old", nil
+	}
+
+	t.Run("fresh", func(t *testing.T) {
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+		v, err := dispatcher.DoWithContextTimeout(context.Background(), "key", 1*time.Second, fast)
+		if v != "old" || err != nil {
+			t.Errorf("DoWithContextTimeout() = %v, %v, want old, nil", v, err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		refreshed := make(chan struct{})
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+		dispatcher.DoWithContextTimeout(context.Background(), "key", 1*time.Second, fast)
+		dispatcher.Expire("key")
+
+		v, err := dispatcher.DoWithContextTimeout(context.Background(), "key", 10*time.Millisecond, func(ctx context.Context) (interface{}, error) {
+			defer close(refreshed)
+			return slow(ctx)
+		})
+		if v != "old" || err != callcache.ErrFallback {
+			t.Errorf("DoWithContextTimeout() = %v, %v, want old, %v", v, err, callcache.ErrFallback)
+		}
+
+		release <- struct{}{}
+		<-refreshed
+		for i := 0; i < 100; i++ {
+			if v, _ := dispatcher.Peek("key"); v == "new" {
+				return
+			}
+			time.Sleep(1 * time.Millisecond)
+		}
+		t.Error("the result of fn after the timeout is not cached")
+	})
+
+	t.Run("no stale", func(t *testing.T) {
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+		defer func() { release <- struct{}{} }()
+
+		v, err := dispatcher.DoWithContextTimeout(context.Background(), "key", 10*time.Millisecond, slow)
+		if v != nil || err != callcache.ErrTimeout {
+			t.Errorf("DoWithContextTimeout() = %v, %v, want nil, %v", v, err, callcache.ErrTimeout)
+		}
+
+		// The deadline of ctx comes before the timeout.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		v, err = dispatcher.DoWithContextTimeout(ctx, "key", 1*time.Minute, slow)
+		if v != nil || err != context.DeadlineExceeded {
+			t.Errorf("DoWithContextTimeout() with a deadline = %v, %v, want nil, %v", v, err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestWithLeaderHandoff(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []callcache.Option
+		want      interface{}
+		wantErr   error
+		wantCalls int32
+	}{
+		{name: "default", want: nil, wantErr: context.Canceled, wantCalls: 1},
+		{name: "handoff", opts: []callcache.Option{callcache.WithLeaderHandoff()}, want: "value", wantErr: nil, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, tt.opts...)
+
+			var calls int32
+			started := make(chan struct{})
+			fn := func(ctx context.Context) (interface{}, error) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					close(started)
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return "value", nil
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			leader := make(chan error, 1)
+			go func() {
+				_, err := dispatcher.DoContext(ctx, "key", fn)
+				leader <- err
+			}()
+			<-started
+
+			follower := make(chan error, 1)
+			var v interface{}
+			go func() {
+				var err error
+				v, err = dispatcher.DoContext(context.Background(), "key", fn)
+				follower <- err
+			}()
+			for dispatcher.Waiters("key") != 2 {
+				time.Sleep(1 * time.Millisecond)
+			}
+			cancel()
+
+			if err := <-leader; err != context.Canceled {
+				t.Errorf("DoContext() of the leader error = %v, want %v", err, context.Canceled)
+			}
+			if err := <-follower; v != tt.want || err != tt.wantErr {
+				t.Errorf("DoContext() of the follower = %v, %v, want %v, %v", v, err, tt.want, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("fn was called %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package callcache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"time"
+)
+
+// DebugInfo is the information recorded by WithDebugStacks.
+type DebugInfo struct {
+	// Stack is the stack trace of the goroutine that executed fn for the
+	// first time.
+	Stack []byte
+	// ExecutedAt is when fn was executed for the first time.
+	ExecutedAt time.Time
+}
+
+// DebugInfo returns the DebugInfo of the given key. The boolean is false if it
+// has not been recorded.
+func (d *Dispatcher) DebugInfo(key string) (DebugInfo, bool) {
+	if d.checkKey(key) != nil {
+		return DebugInfo{}, false
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return DebugInfo{}, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.debug == nil {
+		return DebugInfo{}, false
+	}
+	return *c.debug, true
+}
+
+// recordStack records the DebugInfo of c unless it has already been recorded.
+func (c *call) recordStack() {
+	c.mu.RLock()
+	recorded := c.debug != nil
+	c.mu.RUnlock()
+	if recorded {
+		return
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n := runtime.Stack(buf, false)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	c.mu.Lock()
+	if c.debug == nil {
+		c.debug = &DebugInfo{Stack: buf, ExecutedAt: c.d.clock.Now()}
+	}
+	c.mu.Unlock()
+}
+
+// fingerprint returns a hash of the content of v as printed by fmt, which
+// covers the elements of slices and maps and the fields of structs, including
+// the ones behind a pointer to them, but not behind nested pointers.
+func fingerprint(v interface{}) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%#v", v)
+	return h.Sum64()
+}
+
+// checkFrozen calls the function set by WithFreezeCheck if v has been mutated
+// since it was stored. c.mu must be held.
+func (c *call) checkFrozen(v interface{}) {
+	if fingerprint(v) != c.fingerprint {
+		c.d.freezeCheck(c.key)
+	}
+}
+
+// flight is the fingerprint of the callers of DoWithFingerprint waiting for an
+// execution of a call.
+type flight struct {
+	fingerprint interface{}
+	waiters     int
+}
+
+// DoWithFingerprint is like Do, but the caller gives a fingerprint of what fn
+// computes, such as its parameters, which is checked against the other callers
+// waiting for the same execution with WithConsistencyCheck.
+func (d *Dispatcher) DoWithFingerprint(key string, fingerprint interface{}, fn func() (interface{}, error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	return d.call(key).do(work{fn: fn, fingerprint: fingerprint, hasFingerprint: true})
+}
+
+// checkConsistency registers fingerprint for an execution of c and calls the
+// function set by WithConsistencyCheck if it differs from the one registered
+// first. It returns a function to unregister it.
+func (c *call) checkConsistency(fingerprint interface{}) func() {
+	c.mu.Lock()
+	if c.flight == nil {
+		c.flight = &flight{fingerprint: fingerprint}
+	}
+	f := c.flight
+	f.waiters++
+	c.mu.Unlock()
+	if f.fingerprint != fingerprint {
+		c.d.consistencyCheck(c.key, f.fingerprint, fingerprint)
+	}
+
+	return func() {
+		c.mu.Lock()
+		if f.waiters--; f.waiters == 0 && c.flight == f {
+			c.flight = nil
+		}
+		c.mu.Unlock()
+	}
+}
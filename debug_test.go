@@ -0,0 +1,117 @@
+package callcache_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithDebugStacks(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Nanosecond, 0, callcache.WithDebugStacks())
+
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+	dispatcher.Do("key", fn)
+
+	info, ok := dispatcher.DebugInfo("key")
+	if !ok {
+		t.Fatal("DebugInfo() = false, want true")
+	}
+	if !bytes.Contains(info.Stack, []byte("TestWithDebugStacks")) {
+		t.Errorf("Stack = %s, want the caller of Do", info.Stack)
+	}
+
+	time.Sleep(1 * time.Millisecond)
+	dispatcher.Do("key", fn)
+	if again, _ := dispatcher.DebugInfo("key"); !again.ExecutedAt.Equal(info.ExecutedAt) {
+		t.Errorf("ExecutedAt = %v, want the first execution at %v", again.ExecutedAt, info.ExecutedAt)
+	}
+
+	if _, ok := dispatcher.DebugInfo("unknown"); ok {
+		t.Error("DebugInfo() = true for unknown key, want false")
+	}
+}
+
+func TestDispatcher_DebugInfo_disabled(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+
+	dispatcher.Do("key", func() (interface{}, error) {
+		return "value", nil
+	})
+	if _, ok := dispatcher.DebugInfo("key"); ok {
+		t.Error("DebugInfo() = true, want false")
+	}
+}
+
+func TestWithFreezeCheck(t *testing.T) {
+	var mutated []string
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithFreezeCheck(func(key string) {
+		mutated = append(mutated, key)
+	}))
+
+	shared := []int{1, 2, 3}
+	dispatcher.Do("slice", func() (interface{}, error) { return shared, nil })
+	dispatcher.Do("copy", func() (interface{}, error) { return append([]int(nil), shared...), nil })
+	dispatcher.Do("slice", nil)
+	dispatcher.Do("copy", nil)
+	if len(mutated) != 0 {
+		t.Fatalf("mutated = %v before any mutation, want none", mutated)
+	}
+
+	shared[0] = 100
+	dispatcher.Do("slice", nil)
+	dispatcher.Do("copy", nil)
+	if want := []string{"slice"}; !reflect.DeepEqual(mutated, want) {
+		t.Errorf("mutated = %v, want %v", mutated, want)
+	}
+}
+
+func TestWithConsistencyCheck(t *testing.T) {
+	var mu sync.Mutex
+	var warnings []string
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithConsistencyCheck(func(key string, leader, follower interface{}) {
+		mu.Lock()
+		warnings = append(warnings, fmt.Sprintf("%s:%v:%v", key, leader, follower))
+		mu.Unlock()
+	}))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		close(started)
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	for i, fingerprint := range []string{"a", "a", "b"} {
+		fingerprint := fingerprint
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dispatcher.DoWithFingerprint("key", fingerprint, fn)
+		}()
+		if i == 0 {
+			<-started
+		}
+	}
+	for dispatcher.Waiters("key") != 3 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	// The next execution is not compared with the previous one.
+	dispatcher.Expire("key")
+	dispatcher.DoWithFingerprint("key", "b", func() (interface{}, error) { return "value", nil })
+
+	if want := []string{"key:a:b"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("warnings = %v, want %v", warnings, want)
+	}
+}
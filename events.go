@@ -0,0 +1,82 @@
+package callcache
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the type of an Event.
+type EventType int
+
+const (
+	// EventRefresh is an update of a key in the background.
+	EventRefresh EventType = iota
+	// EventEvict is a removal of a key.
+	EventEvict
+)
+
+// Event is an event of a key delivered by WithBatchedEvents.
+type Event struct {
+	Type EventType
+	Key  string
+	Time time.Time
+}
+
+// eventBatcher buffers events and delivers them in batches.
+type eventBatcher struct {
+	mu       sync.Mutex
+	events   []Event
+	maxBatch int
+
+	// deliverMu serializes the deliveries so that the batches are delivered
+	// in order.
+	deliverMu sync.Mutex
+	deliver   func([]Event)
+}
+
+// emit buffers the event of the given type and key, and flushes the buffer if
+// it is full.
+func (d *Dispatcher) emit(typ EventType, key string) {
+	b := d.events
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.events = append(b.events, Event{Type: typ, Key: key, Time: d.clock.Now()})
+	full := len(b.events) >= b.maxBatch
+	b.mu.Unlock()
+	if full {
+		b.flush()
+	}
+}
+
+// flush delivers the buffered events if any.
+func (b *eventBatcher) flush() {
+	b.deliverMu.Lock()
+	defer b.deliverMu.Unlock()
+
+	b.mu.Lock()
+	events := b.events
+	b.events = nil
+	b.mu.Unlock()
+	if len(events) > 0 {
+		b.deliver(events)
+	}
+}
+
+// flushEvents flushes the buffered events every interval until the Dispatcher
+// is closed.
+func (d *Dispatcher) flushEvents(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.events.flush()
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package callcache_test
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithBatchedEvents(t *testing.T) {
+	t.Run("max batch", func(t *testing.T) {
+		var batches [][]callcache.Event
+		// Without a flush interval, the events are delivered only by maxBatch.
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithBatchedEvents(0, 10, func(events []callcache.Event) {
+			batches = append(batches, events)
+		}))
+		for i := 0; i < 25; i++ {
+			key := strconv.Itoa(i)
+			dispatcher.Set(key, i)
+			dispatcher.Remove(key)
+		}
+		if len(batches) != 2 {
+			t.Fatalf("got %d batches before Close(), want 2", len(batches))
+		}
+		dispatcher.Close()
+
+		var sizes []int
+		var keys []string
+		for _, batch := range batches {
+			sizes = append(sizes, len(batch))
+			for _, e := range batch {
+				if e.Type != callcache.EventEvict {
+					t.Errorf("Type of %s = %v, want %v", e.Key, e.Type, callcache.EventEvict)
+				}
+				keys = append(keys, e.Key)
+			}
+		}
+		if want := []int{10, 10, 5}; !reflect.DeepEqual(sizes, want) {
+			t.Errorf("batch sizes = %v, want %v", sizes, want)
+		}
+		for i, key := range keys {
+			if want := strconv.Itoa(i); key != want {
+				t.Errorf("keys[%d] = %s, want %s", i, key, want)
+			}
+		}
+	})
+
+	t.Run("flush interval", func(t *testing.T) {
+		var mu sync.Mutex
+		var received []callcache.Event
+		delivered := make(chan struct{}, 1)
+		dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithBatchedEvents(10*time.Millisecond, 100, func(events []callcache.Event) {
+			mu.Lock()
+			received = append(received, events...)
+			mu.Unlock()
+			delivered <- struct{}{}
+		}))
+		defer dispatcher.Close()
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			dispatcher.Set(strconv.Itoa(i), i)
+			dispatcher.Remove(strconv.Itoa(i))
+		}
+		for n := 0; n < 3; {
+			<-delivered
+			mu.Lock()
+			n = len(received)
+			mu.Unlock()
+		}
+		if elapsed := time.Since(start); elapsed > 1*time.Second {
+			t.Errorf("events were delivered after %v, want shortly after the flush interval", elapsed)
+		}
+	})
+}
@@ -0,0 +1,260 @@
+package callcache
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+)
+
+// EvictionPolicy decides which key is evicted by WithMaxEntries.
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently used key.
+	LRU EvictionPolicy = iota
+	// SLRU is the segmented LRU, which splits the keys into the probationary
+	// and protected segments. New keys enter the probationary segment and are
+	// promoted to the protected segment when they are used again, so that the
+	// keys used only once, such as by a scan, do not evict the frequently
+	// used keys. The key to evict is taken from the probationary segment first.
+	SLRU
+)
+
+// EvictReason is the reason why a key is removed, which is given to the
+// function set by WithOnEvict.
+type EvictReason int
+
+const (
+	// EvictRemoved is an explicit removal, such as by Remove, Take, or Clear.
+	EvictRemoved EvictReason = iota
+	// EvictCapacity is an eviction by WithMaxEntries.
+	EvictCapacity
+	// EvictIdle is a removal by WithIdleTimeout.
+	EvictIdle
+	// EvictFailures is a removal by WithRemoveAfterFailures.
+	EvictFailures
+	// EvictExpired is a removal of an expired result by RemoveExpired, such as
+	// with WithExpiredReaping.
+	EvictExpired
+	// EvictMemory is an eviction by WithMemoryPressureEviction.
+	EvictMemory
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictRemoved:
+		return "removed"
+	case EvictCapacity:
+		return "capacity"
+	case EvictIdle:
+		return "idle"
+	case EvictFailures:
+		return "failures"
+	case EvictExpired:
+		return "expired"
+	case EvictMemory:
+		return "memory"
+	}
+	return "EvictReason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// evictor tracks the usage of the calls to choose the calls to evict.
+type evictor interface {
+	// add adds c unless it has already been added or is pinned, and returns
+	// the calls to evict.
+	add(c *call) []*call
+	// touch marks c as used.
+	touch(c *call)
+	// remove removes c that has been removed from the Dispatcher.
+	remove(c *call)
+	// pin removes c pinned by Pin, which is added again by add when unpinned.
+	pin(c *call)
+	// victim removes and returns the call to evict next, or nil if there is
+	// none.
+	victim() *call
+}
+
+// evictionEntry is the state of a call owned by the evictor.
+type evictionEntry struct {
+	elem      *list.Element
+	protected bool
+	removed   bool
+}
+
+func newEvictor(policy EvictionPolicy, maxEntries int) evictor {
+	if policy == SLRU {
+		protected := maxEntries * 4 / 5
+		if protected < 1 {
+			protected = 1
+		}
+		return &slru{
+			maxEntries:   maxEntries,
+			maxProtected: protected,
+			probation:    list.New(),
+			protected:    list.New(),
+		}
+	}
+	return &lru{maxEntries: maxEntries, list: list.New()}
+}
+
+type lru struct {
+	mu         sync.Mutex
+	maxEntries int
+	list       *list.List
+}
+
+func (l *lru) add(c *call) []*call {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c.entry.removed || c.entry.elem != nil || c.isPinned() {
+		return nil
+	}
+	c.entry.elem = l.list.PushFront(c)
+
+	var victims []*call
+	for l.list.Len() > l.maxEntries {
+		victims = append(victims, l.evict())
+	}
+	return victims
+}
+
+func (l *lru) victim() *call {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.list.Len() == 0 {
+		return nil
+	}
+	return l.evict()
+}
+
+// evict removes the least recently used call. l.mu must be held.
+func (l *lru) evict() *call {
+	victim := l.list.Remove(l.list.Back()).(*call)
+	victim.entry = evictionEntry{removed: true}
+	return victim
+}
+
+func (l *lru) touch(c *call) {
+	l.mu.Lock()
+	if c.entry.elem != nil {
+		l.list.MoveToFront(c.entry.elem)
+	}
+	l.mu.Unlock()
+}
+
+func (l *lru) remove(c *call) {
+	l.mu.Lock()
+	if c.entry.elem != nil {
+		l.list.Remove(c.entry.elem)
+	}
+	c.entry = evictionEntry{removed: true}
+	l.mu.Unlock()
+}
+
+func (l *lru) pin(c *call) {
+	l.mu.Lock()
+	if c.entry.elem != nil {
+		l.list.Remove(c.entry.elem)
+		c.entry.elem = nil
+	}
+	l.mu.Unlock()
+}
+
+type slru struct {
+	mu           sync.Mutex
+	maxEntries   int
+	maxProtected int
+	probation    *list.List
+	protected    *list.List
+}
+
+func (l *slru) add(c *call) []*call {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c.entry.removed || c.entry.elem != nil || c.isPinned() {
+		return nil
+	}
+	c.entry.elem = l.probation.PushFront(c)
+
+	var victims []*call
+	for l.probation.Len()+l.protected.Len() > l.maxEntries {
+		victims = append(victims, l.evict())
+	}
+	return victims
+}
+
+func (l *slru) victim() *call {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.probation.Len()+l.protected.Len() == 0 {
+		return nil
+	}
+	return l.evict()
+}
+
+// evict removes the call to evict, which is taken from the probationary
+// segment first. l.mu must be held.
+func (l *slru) evict() *call {
+	segment := l.probation
+	if segment.Len() == 0 {
+		segment = l.protected
+	}
+	victim := segment.Remove(segment.Back()).(*call)
+	victim.entry = evictionEntry{removed: true}
+	return victim
+}
+
+func (l *slru) touch(c *call) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c.entry.elem == nil {
+		return
+	}
+	if c.entry.protected {
+		l.protected.MoveToFront(c.entry.elem)
+		return
+	}
+
+	l.probation.Remove(c.entry.elem)
+	c.entry.elem = l.protected.PushFront(c)
+	c.entry.protected = true
+	if l.protected.Len() > l.maxProtected {
+		demoted := l.protected.Remove(l.protected.Back()).(*call)
+		demoted.entry.elem = l.probation.PushFront(demoted)
+		demoted.entry.protected = false
+	}
+}
+
+func (l *slru) remove(c *call) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c.entry.elem != nil {
+		if c.entry.protected {
+			l.protected.Remove(c.entry.elem)
+		} else {
+			l.probation.Remove(c.entry.elem)
+		}
+	}
+	c.entry = evictionEntry{removed: true}
+}
+
+func (l *slru) pin(c *call) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c.entry.elem == nil {
+		return
+	}
+	if c.entry.protected {
+		l.protected.Remove(c.entry.elem)
+	} else {
+		l.probation.Remove(c.entry.elem)
+	}
+	c.entry.elem, c.entry.protected = nil, false
+}
@@ -0,0 +1,201 @@
+package callcache_test
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithMaxEntries(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithMaxEntries(3))
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	for _, key := range []string{"a", "b", "c", "a", "d"} {
+		dispatcher.Do(key, fn)
+	}
+
+	keys := dispatcher.Keys()
+	sort.Strings(keys)
+	if fmt.Sprint(keys) != "[a c d]" {
+		t.Errorf("Keys() = %v, want [a c d]", keys)
+	}
+}
+
+func TestWithEvictionPolicy_scan(t *testing.T) {
+	tests := []struct {
+		policy  callcache.EvictionPolicy
+		wantHot bool
+	}{
+		{policy: callcache.LRU, wantHot: false},
+		{policy: callcache.SLRU, wantHot: true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(int(tt.policy)), func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+				callcache.WithMaxEntries(10),
+				callcache.WithEvictionPolicy(tt.policy),
+			)
+			fn := func() (interface{}, error) {
+				return "value", nil
+			}
+
+			dispatcher.Do("hot", fn)
+			dispatcher.Do("hot", fn)
+			for i := 0; i < 100; i++ {
+				dispatcher.Do(fmt.Sprintf("scan%d", i), fn)
+			}
+
+			_, ok := dispatcher.Config("hot")
+			if ok != tt.wantHot {
+				t.Errorf("hot key exists = %v, want %v", ok, tt.wantHot)
+			}
+			if n := len(dispatcher.Keys()); n != 10 {
+				t.Errorf("len(Keys()) = %d, want 10", n)
+			}
+		})
+	}
+}
+
+func BenchmarkEvictionPolicy_scanHitRate(b *testing.B) {
+	// Each cycle accesses the hot keys twice, followed by a burst of a scan.
+	const (
+		maxEntries = 100
+		hotKeys    = 50
+		scanKeys   = 200
+		cycle      = 2*hotKeys + scanKeys
+	)
+
+	for _, policy := range []struct {
+		name   string
+		policy callcache.EvictionPolicy
+	}{
+		{name: "LRU", policy: callcache.LRU},
+		{name: "SLRU", policy: callcache.SLRU},
+	} {
+		b.Run(policy.name, func(b *testing.B) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+				callcache.WithMaxEntries(maxEntries),
+				callcache.WithEvictionPolicy(policy.policy),
+			)
+			var misses int
+			fn := func() (interface{}, error) {
+				misses++
+				return "value", nil
+			}
+
+			var hotAccesses, hotMisses int
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if j := i % cycle; j < 2*hotKeys {
+					before := misses
+					dispatcher.Do("hot"+strconv.Itoa(j%hotKeys), fn)
+					hotAccesses++
+					hotMisses += misses - before
+				} else {
+					dispatcher.Do("scan"+strconv.Itoa(i), fn)
+				}
+			}
+			if hotAccesses > 0 {
+				b.ReportMetric(float64(hotAccesses-hotMisses)/float64(hotAccesses), "hot-hit-rate")
+			}
+		})
+	}
+}
+
+func TestWithOnEvict(t *testing.T) {
+	errBackend := errors.New("backend error")
+	ok := func() (interface{}, error) { return "value", nil }
+	failing := func() (interface{}, error) { return nil, errBackend }
+
+	tests := []struct {
+		name   string
+		opts   []callcache.Option
+		remove func(d *callcache.Dispatcher)
+		want   callcache.EvictReason
+	}{
+		{
+			name:   "Remove",
+			remove: func(d *callcache.Dispatcher) { d.Remove("key") },
+			want:   callcache.EvictRemoved,
+		},
+		{
+			name:   "Take",
+			remove: func(d *callcache.Dispatcher) { d.Take("key") },
+			want:   callcache.EvictRemoved,
+		},
+		{
+			name:   "Clear",
+			remove: func(d *callcache.Dispatcher) { d.Clear() },
+			want:   callcache.EvictRemoved,
+		},
+		{
+			name:   "WithMaxEntries",
+			opts:   []callcache.Option{callcache.WithMaxEntries(1)},
+			remove: func(d *callcache.Dispatcher) { d.Do("other", ok) },
+			want:   callcache.EvictCapacity,
+		},
+		{
+			name:   "WithIdleTimeout",
+			opts:   []callcache.Option{callcache.WithIdleTimeout(10 * time.Millisecond)},
+			remove: func(d *callcache.Dispatcher) {},
+			want:   callcache.EvictIdle,
+		},
+		{
+			name: "WithRemoveAfterFailures",
+			opts: []callcache.Option{callcache.WithRemoveAfterFailures(1)},
+			remove: func(d *callcache.Dispatcher) {
+				d.Expire("key")
+				d.Do("key", failing)
+			},
+			want: callcache.EvictFailures,
+		},
+		{
+			name: "RemoveExpired",
+			remove: func(d *callcache.Dispatcher) {
+				d.Expire("key")
+				d.RemoveExpired()
+			},
+			want: callcache.EvictExpired,
+		},
+		{
+			name:   "WithExpiredReaping",
+			opts:   []callcache.Option{callcache.WithExpiredReaping(10 * time.Millisecond)},
+			remove: func(d *callcache.Dispatcher) { d.Bump() },
+			want:   callcache.EvictExpired,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			reasons := make(chan callcache.EvictReason, 1)
+			opts := append([]callcache.Option{
+				callcache.WithOnEvict(func(key string, v interface{}, reason callcache.EvictReason) {
+					if key != "key" || v != "value" {
+						t.Errorf("evicted %s = %v, want key = value", key, v)
+					}
+					reasons <- reason
+				}),
+			}, tt.opts...)
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, opts...)
+			defer dispatcher.Close()
+
+			dispatcher.Do("key", ok)
+			tt.remove(dispatcher)
+			select {
+			case reason := <-reasons:
+				if reason != tt.want {
+					t.Errorf("reason = %v, want %v", reason, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the key was not evicted")
+			}
+		})
+	}
+}
@@ -48,19 +48,22 @@ func ExampleNewDispatcher_expiration() {
 	// 2
 	// 3
 }
+
 func ExampleNewDispatcher_updateInterval() {
-	dispatcher := callcache.NewDispatcher(1*time.Minute, 1*time.Nanosecond)
+	refreshed := make(chan string)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 1*time.Nanosecond, callcache.WithRefreshDoneHook(func(key string) {
+		refreshed <- key
+	}))
 
-	wg := sync.WaitGroup{}
 	results := make([]interface{}, 3)
 	for i := range results {
-		wg.Add(1)
 		results[i], _ = dispatcher.Do("key", func() (interface{}, error) {
-			defer wg.Done()
 			fmt.Printf("Do: #%d\n", i+1)
 			return i + 1, nil
 		})
-		wg.Wait()
+		if i > 0 {
+			<-refreshed
+		}
 		time.Sleep(1 * time.Nanosecond)
 	}
 
@@ -176,3 +179,116 @@ func ExampleDispatcher_Remove() {
 	// 1
 	// 2
 }
+
+func ExampleDispatcher_DoBatch() {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	results := dispatcher.DoBatch([]string{"a", "b", "a", "c", "b"}, func(key string) (interface{}, error) {
+		mu.Lock()
+		calls[key]++
+		mu.Unlock()
+		return "value of " + key, nil
+	})
+
+	for _, key := range []string{"a", "b", "c"} {
+		fmt.Println(results[key].Val, results[key].Err, calls[key])
+	}
+	// Output:
+	// value of a <nil> 1
+	// value of b <nil> 1
+	// value of c <nil> 1
+}
+
+func ExampleDispatcher_Take() {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+
+	dispatcher.Do("key", func() (interface{}, error) {
+		return "token", nil
+	})
+
+	fmt.Println(dispatcher.Take("key"))
+	fmt.Println(dispatcher.Take("key"))
+	// Output:
+	// token true
+	// <nil> false
+}
+
+func ExampleDispatcher_DoWithSeed() {
+	refreshed := make(chan string)
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Millisecond, callcache.WithRefreshDoneHook(func(key string) {
+		refreshed <- key
+	}))
+
+	fn := func() (interface{}, error) {
+		fmt.Println("Do")
+		return "value", nil
+	}
+
+	v1, _ := dispatcher.DoWithSeed("key", "seed", fn)
+	time.Sleep(20 * time.Millisecond)
+	v2, _ := dispatcher.DoWithSeed("key", "seed", fn)
+	<-refreshed
+	v3, _ := dispatcher.DoWithSeed("key", "seed", fn)
+
+	fmt.Println(v1)
+	fmt.Println(v2)
+	fmt.Println(v3)
+	// Output:
+	// Do
+	// seed
+	// seed
+	// value
+}
+
+func ExampleDispatcher_Set() {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+
+	dispatcher.Set("key", "value")
+	v, _ := dispatcher.Do("key", func() (interface{}, error) {
+		fmt.Println("Do")
+		return "example", nil
+	})
+
+	fmt.Println(v)
+	// Output:
+	// value
+}
+
+func ExampleDispatcher_RemoveByPrefix() {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+
+	for _, key := range []string{"user:1", "user:2", "group:1"} {
+		dispatcher.Set(key, key)
+	}
+
+	fmt.Println(dispatcher.RemoveByPrefix("user:"))
+	fmt.Println(dispatcher.Keys())
+	dispatcher.Clear()
+	fmt.Println(dispatcher.Keys())
+	// Output:
+	// 2
+	// [group:1]
+	// []
+}
+
+func ExampleWithOnFirstLoad() {
+	dispatcher := callcache.NewDispatcher(1*time.Nanosecond, 0, callcache.WithOnFirstLoad(func(key string, v interface{}) {
+		fmt.Printf("first load of %s: %v\n", key, v)
+	}))
+
+	for i := 1; i <= 3; i++ {
+		dispatcher.Do("key", func() (interface{}, error) {
+			return i, nil
+		})
+		time.Sleep(1 * time.Millisecond)
+	}
+	dispatcher.Remove("key")
+	dispatcher.Do("key", func() (interface{}, error) {
+		return 4, nil
+	})
+	// Output:
+	// first load of key: 1
+	// first load of key: 4
+}
@@ -0,0 +1,87 @@
+package callcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// exportRecord is a line of Export.
+type exportRecord struct {
+	Key      string          `json:"key"`
+	StoredAt time.Time       `json:"storedAt"`
+	Value    json.RawMessage `json:"value"`
+}
+
+// Export writes the cached results to w as newline-delimited JSON records of
+// the key, the time the result was stored and the result encoded by encode,
+// which must return JSON, such as json.Marshal. Unlike Snapshot, it locks one
+// shard at a time to list its keys and one key at a time to read its result,
+// so that it does not hold all the results in memory nor block the Dispatcher
+// while writing, but it may mix the results before and after concurrent
+// updates. The keys are written as they are stored with WithKeyHasher.
+func (d *Dispatcher) Export(w io.Writer, encode func(v interface{}) ([]byte, error)) error {
+	enc := json.NewEncoder(w)
+	for _, s := range d.shards {
+		s.mu.RLock()
+		calls := make([]*call, 0, len(s.calls))
+		for _, c := range s.calls {
+			calls = append(calls, c)
+		}
+		s.mu.RUnlock()
+
+		for _, c := range calls {
+			c.mu.RLock()
+			v, ok := c.value()
+			at := c.lastUpdate
+			c.mu.RUnlock()
+			if !ok {
+				continue
+			}
+
+			b, err := encode(v)
+			if err != nil {
+				return fmt.Errorf("callcache: encode %q: %w", c.key, err)
+			}
+			if err := enc.Encode(exportRecord{Key: c.key, StoredAt: at, Value: b}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Import reads the records written by Export from r, decodes the results by
+// decode, and stores them with the time they were stored, so that they keep
+// their freshness. The existing results of the keys are replaced. The keys are
+// checked by WithRejectEmptyKey and WithKeyValidator as they are written, even
+// with WithKeyHasher. It returns the first error if any, such as of a rejected
+// key, after which the rest of r is not read.
+func (d *Dispatcher) Import(r io.Reader, decode func(b []byte) (interface{}, error)) error {
+	dec := json.NewDecoder(r)
+	for {
+		var rec exportRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := d.checkKey(rec.Key); err != nil {
+			return fmt.Errorf("callcache: import %q: %w", rec.Key, err)
+		}
+		v, err := decode(rec.Value)
+		if err != nil {
+			return fmt.Errorf("callcache: decode %q: %w", rec.Key, err)
+		}
+		c := d.hashedCall(rec.Key)
+		c.mu.Lock()
+		first := c.store(v, rec.StoredAt)
+		c.mu.Unlock()
+		c.accessed(d.clock.Now())
+		if first {
+			c.firstLoaded(v)
+		}
+	}
+}
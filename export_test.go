@@ -0,0 +1,111 @@
+package callcache_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_Export(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	src := callcache.NewDispatcher(1*time.Hour, 0, callcache.WithClock(clock))
+	for i := 0; i < 10000; i++ {
+		src.Set("key"+strconv.Itoa(i), i)
+		clock.Add(1 * time.Millisecond)
+	}
+	src.Do("failed", func() (interface{}, error) { return nil, errors.New("failed") })
+
+	var buf bytes.Buffer
+	if err := src.Export(&buf, json.Marshal); err != nil {
+		t.Fatal(err)
+	}
+	dst := callcache.NewDispatcher(1*time.Hour, 0, callcache.WithClock(clock))
+	err := dst.Import(&buf, func(b []byte) (interface{}, error) {
+		var v int
+		err := json.Unmarshal(b, &v)
+		return v, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, got := src.Snapshot(), dst.Snapshot()
+	if len(got) != len(want) {
+		t.Errorf("imported %d entries, want %d", len(got), len(want))
+	}
+	for key, w := range want {
+		if g := got[key]; g.Value != w.Value || !g.LastUpdate.Equal(w.LastUpdate) {
+			t.Errorf("imported %s = %+v, want %+v", key, g, w)
+		}
+	}
+	if _, ok := dst.Peek("failed"); ok {
+		t.Error("Peek(failed) = true, want false")
+	}
+}
+
+func TestDispatcher_Export_error(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Hour, 0)
+	dispatcher.Set("key", "value")
+	errEncode := errors.New("encode error")
+
+	var buf bytes.Buffer
+	err := dispatcher.Export(&buf, func(interface{}) ([]byte, error) { return nil, errEncode })
+	if !errors.Is(err, errEncode) {
+		t.Errorf("Export() = %v, want %v", err, errEncode)
+	}
+
+	record := `{"key":"key","storedAt":"` + time.Now().Format(time.RFC3339Nano) + `","value":1}`
+	err = dispatcher.Import(bytes.NewBufferString(record+"\n{"), func([]byte) (interface{}, error) {
+		return "imported", nil
+	})
+	if err == nil {
+		t.Error("Import() of a truncated record = nil, want an error")
+	}
+	if v, _ := dispatcher.Peek("key"); v != "imported" {
+		t.Errorf("Peek() = %v, want the record before the error", v)
+	}
+}
+
+func TestDispatcher_Import_invalidKey(t *testing.T) {
+	storedAt := time.Now().Format(time.RFC3339Nano)
+	tests := []struct {
+		name    string
+		opts    []callcache.Option
+		key     string
+		wantErr error
+	}{
+		{name: "empty", opts: []callcache.Option{callcache.WithRejectEmptyKey(false)}, key: "", wantErr: callcache.ErrEmptyKey},
+		{
+			name: "invalid",
+			opts: []callcache.Option{callcache.WithKeyValidator(func(key string) error {
+				if key == "bad" {
+					return errors.New("bad key")
+				}
+				return nil
+			})},
+			key:     "bad",
+			wantErr: callcache.ErrInvalidKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Hour, 0, tt.opts...)
+			records := `{"key":"good","storedAt":"` + storedAt + `","value":1}` + "\n" +
+				`{"key":"` + tt.key + `","storedAt":"` + storedAt + `","value":1}` + "\n"
+			err := dispatcher.Import(bytes.NewBufferString(records), func([]byte) (interface{}, error) {
+				return "imported", nil
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Import() = %v, want %v", err, tt.wantErr)
+			}
+			if keys := dispatcher.Keys(); len(keys) != 1 || keys[0] != "good" {
+				t.Errorf("Keys() = %v, want [good]", keys)
+			}
+		})
+	}
+}
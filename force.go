@@ -0,0 +1,45 @@
+package callcache
+
+import "sync/atomic"
+
+// ForceRefreshMode decides how the concurrent calls of ForceRefresh for the
+// same key share the executions of fn.
+type ForceRefreshMode int
+
+const (
+	// CoalesceRefresh makes the concurrent calls share one execution of fn,
+	// including the one already running for Do, so that fn is not executed
+	// more than once at a time. The result may be from an execution started
+	// before the call.
+	CoalesceRefresh ForceRefreshMode = iota
+	// IsolateRefresh makes each call get the result of an execution of fn
+	// started after it is called, so that the result is never older than the
+	// call. The executions may run concurrently, and the latest started one
+	// is cached.
+	IsolateRefresh
+)
+
+// ForceRefresh executes fn for the given key even if its execution result is
+// fresh, stores the result, and returns it. How the concurrent calls for the
+// key share the executions is decided by mode.
+func (d *Dispatcher) ForceRefresh(key string, mode ForceRefreshMode, fn func() (interface{}, error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	c := d.call(key)
+	w := work{fn: fn, force: true}
+	if mode != IsolateRefresh {
+		return c.update(w)
+	}
+
+	atomic.AddInt64(&c.waiters, 1)
+	defer atomic.AddInt64(&c.waiters, -1)
+
+	// Forgetting the running execution makes this call start another one,
+	// which the calls made after this one may share.
+	c.group.Forget("force")
+	v, err, _ := c.group.Do("force", func() (interface{}, error) {
+		return c.execute(w)
+	})
+	return v, err
+}
@@ -0,0 +1,78 @@
+package callcache_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_ForceRefresh(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      callcache.ForceRefreshMode
+		wantCalls int32
+	}{
+		{name: "coalesce", mode: callcache.CoalesceRefresh, wantCalls: 1},
+		{name: "isolate", mode: callcache.IsolateRefresh, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+			dispatcher.Set("key", 0)
+
+			var calls int32
+			started := make(chan struct{}, 3)
+			release := make(chan struct{})
+			fn := func() (interface{}, error) {
+				n := atomic.AddInt32(&calls, 1)
+				started <- struct{}{}
+				<-release
+				return int(n), nil
+			}
+
+			var wg sync.WaitGroup
+			results := make([]interface{}, 3)
+			for i := range results {
+				i := i
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					v, err := dispatcher.ForceRefresh("key", tt.mode, fn)
+					if err != nil {
+						t.Error(err)
+					}
+					results[i] = v
+				}()
+				if i == 0 || tt.mode == callcache.IsolateRefresh {
+					<-started
+				}
+			}
+			for dispatcher.Waiters("key") != 3 {
+				time.Sleep(1 * time.Millisecond)
+			}
+			close(release)
+			wg.Wait()
+
+			if calls != tt.wantCalls {
+				t.Errorf("fn was called %d times, want %d", calls, tt.wantCalls)
+			}
+			for i, v := range results {
+				want := 1
+				if tt.mode == callcache.IsolateRefresh {
+					want = i + 1
+				}
+				if v != want {
+					t.Errorf("ForceRefresh() #%d = %v, want %d", i, v, want)
+				}
+			}
+			// The latest started execution is cached.
+			if v, _ := dispatcher.Peek("key"); v != int(tt.wantCalls) {
+				t.Errorf("Peek() = %v, want %d", v, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package callcache
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// DoGroupCtx calls DoContext for each of the given jobs concurrently using an
+// errgroup.Group, and returns the results keyed by the keys of jobs along with
+// the first error. By default, the first error cancels the context passed to
+// the other jobs, and the jobs not started yet are skipped; use
+// WithGroupContinueOnError to run all of them regardless. The number of the
+// concurrent jobs can be limited by WithGroupLimit. The results of the failed
+// or skipped jobs are not contained in the returned map.
+func (d *Dispatcher) DoGroupCtx(ctx context.Context, jobs map[string]func(ctx context.Context) (interface{}, error)) (map[string]interface{}, error) {
+	g := new(errgroup.Group)
+	gctx := ctx
+	if !d.groupContinue {
+		g, gctx = errgroup.WithContext(ctx)
+	}
+	if d.groupLimit > 0 {
+		g.SetLimit(d.groupLimit)
+	}
+
+	results := make(map[string]interface{}, len(jobs))
+	var mu sync.Mutex
+	for key, fn := range jobs {
+		if !d.groupContinue && gctx.Err() != nil {
+			break
+		}
+		key, fn := key, fn
+		g.Go(func() error {
+			v, err := d.DoContext(gctx, key, fn)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			results[key] = v
+			mu.Unlock()
+			return nil
+		})
+	}
+	err := g.Wait()
+	return results, err
+}
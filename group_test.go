@@ -0,0 +1,111 @@
+package callcache_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_DoGroupCtx(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+
+	jobs := make(map[string]func(ctx context.Context) (interface{}, error))
+	for i := 0; i < 5; i++ {
+		i := i
+		jobs[strconv.Itoa(i)] = func(context.Context) (interface{}, error) {
+			return i, nil
+		}
+	}
+	results, err := dispatcher.DoGroupCtx(context.Background(), jobs)
+	if err != nil {
+		t.Fatalf("DoGroupCtx() error = %v", err)
+	}
+	if len(results) != len(jobs) {
+		t.Errorf("len(DoGroupCtx()) = %d, want %d", len(results), len(jobs))
+	}
+	for i := 0; i < 5; i++ {
+		if v := results[strconv.Itoa(i)]; v != i {
+			t.Errorf("DoGroupCtx()[%d] = %v, want %d", i, v, i)
+		}
+	}
+}
+
+func TestDispatcher_DoGroupCtx_cancel(t *testing.T) {
+	errBackend := errors.New("backend error")
+
+	tests := []struct {
+		name     string
+		opts     []callcache.Option
+		canceled bool
+	}{
+		{name: "cancel", canceled: true},
+		{name: "continue", opts: []callcache.Option{callcache.WithGroupContinueOnError()}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, tt.opts...)
+
+			started := make(chan struct{})
+			jobs := map[string]func(ctx context.Context) (interface{}, error){
+				"fail": func(context.Context) (interface{}, error) {
+					<-started
+					return nil, errBackend
+				},
+				"slow": func(ctx context.Context) (interface{}, error) {
+					close(started)
+					select {
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					case <-time.After(50 * time.Millisecond):
+						return "slow", nil
+					}
+				},
+			}
+			results, err := dispatcher.DoGroupCtx(context.Background(), jobs)
+			if err != errBackend {
+				t.Errorf("DoGroupCtx() error = %v, want %v", err, errBackend)
+			}
+			if _, ok := results["slow"]; ok == tt.canceled {
+				t.Errorf("DoGroupCtx() = %v, want slow canceled: %v", results, tt.canceled)
+			}
+		})
+	}
+}
+
+func TestWithGroupLimit(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithGroupLimit(2))
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	jobs := make(map[string]func(ctx context.Context) (interface{}, error))
+	for i := 0; i < 10; i++ {
+		jobs[strconv.Itoa(i)] = func(context.Context) (interface{}, error) {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return "value", nil
+		}
+	}
+	results, err := dispatcher.DoGroupCtx(context.Background(), jobs)
+	if err != nil || len(results) != len(jobs) {
+		t.Fatalf("DoGroupCtx() = %d results, %v, want %d, nil", len(results), err, len(jobs))
+	}
+	if peak > 2 {
+		t.Errorf("%d jobs ran concurrently, want at most 2", peak)
+	}
+}
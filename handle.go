@@ -0,0 +1,62 @@
+package callcache
+
+import "sync/atomic"
+
+// Handle refers to the entry of a key returned by DoHandle, which operates on it
+// without looking up the key again. Once the key is removed, the handle keeps
+// referring to the removed entry, which no longer affects the Dispatcher, so a
+// new handle should be taken by DoHandle.
+type Handle struct {
+	c  *call
+	fn func() (interface{}, error)
+}
+
+// DoHandle is like Do, but returns a Handle of the given key along with the
+// error of Do, whose methods use fn to update the result.
+func (d *Dispatcher) DoHandle(key string, fn func() (interface{}, error)) (Handle, error) {
+	if err := d.checkCall(key); err != nil {
+		return Handle{}, err
+	}
+	c := d.call(key)
+	_, err := c.do(work{fn: fn})
+	return Handle{c: c, fn: fn}, err
+}
+
+// Key returns the key of h, which is replaced by WithKeyHasher if any.
+func (h Handle) Key() string {
+	return h.c.key
+}
+
+// Value returns the execution result like Peek. The boolean is false if there
+// is no valid execution result.
+func (h Handle) Value() (interface{}, bool) {
+	now := h.c.d.clock.Now()
+	h.c.mu.RLock()
+	defer h.c.mu.RUnlock()
+	if h.c.age(now) > h.c.ttl() {
+		return nil, false
+	}
+	return h.c.value()
+}
+
+// Do is like Dispatcher.Do for the key of h with fn given to DoHandle.
+func (h Handle) Do() (interface{}, error) {
+	if atomic.LoadInt32(&h.c.d.closed) != 0 {
+		return nil, ErrClosed
+	}
+	return h.c.do(work{fn: h.fn})
+}
+
+// Refresh executes fn given to DoHandle even if the result is fresh, like
+// ForceRefresh with CoalesceRefresh.
+func (h Handle) Refresh() (interface{}, error) {
+	if atomic.LoadInt32(&h.c.d.closed) != 0 {
+		return nil, ErrClosed
+	}
+	return h.c.update(work{fn: h.fn, force: true})
+}
+
+// Remove removes the key of h unless it has already been removed.
+func (h Handle) Remove() {
+	h.c.d.removeCall(h.c, EvictRemoved)
+}
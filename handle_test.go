@@ -0,0 +1,59 @@
+package callcache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_DoHandle(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	var calls int
+	fn := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+	dispatcher.Set("other", "value")
+
+	h, err := dispatcher.DoHandle("key", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := h.Key(); k != "key" {
+		t.Errorf("Key() = %s, want key", k)
+	}
+	if v, ok := h.Value(); v != 1 || !ok {
+		t.Errorf("Value() = %v, %v, want 1, true", v, ok)
+	}
+	if v, err := h.Do(); v != 1 || err != nil {
+		t.Errorf("Do() = %v, %v, want 1, nil", v, err)
+	}
+
+	if v, err := h.Refresh(); v != 2 || err != nil {
+		t.Errorf("Refresh() = %v, %v, want 2, nil", v, err)
+	}
+	if v, _ := dispatcher.Peek("key"); v != 2 {
+		t.Errorf("Peek() after Refresh() = %v, want 2", v)
+	}
+
+	h.Remove()
+	if _, ok := dispatcher.Peek("key"); ok {
+		t.Error("Peek() after Remove() = true, want false")
+	}
+	if v, _ := dispatcher.Peek("other"); v != "value" {
+		t.Errorf("Peek(other) = %v, want value", v)
+	}
+
+	// The removed entry no longer affects the Dispatcher.
+	dispatcher.Do("key", func() (interface{}, error) { return "new", nil })
+	h.Remove()
+	if v, _ := dispatcher.Peek("key"); v != "new" {
+		t.Errorf("Peek() after Remove() of a stale handle = %v, want new", v)
+	}
+
+	dispatcher.Close()
+	if _, err := h.Refresh(); err != callcache.ErrClosed {
+		t.Errorf("Refresh() after Close() = %v, want %v", err, callcache.ErrClosed)
+	}
+}
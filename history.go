@@ -0,0 +1,53 @@
+package callcache
+
+import "time"
+
+// ErrorRecord is an error returned by fn.
+type ErrorRecord struct {
+	Err error
+	At  time.Time
+}
+
+// Errors returns the errors recorded by WithErrorHistory for the given key
+// from the oldest. It is nil if there are none.
+func (d *Dispatcher) Errors(key string) []ErrorRecord {
+	if d.checkKey(key) != nil {
+		return nil
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.errors == nil {
+		return nil
+	}
+	return c.errors.list()
+}
+
+// HistoryEntry is an execution result recorded by WithHistory.
+type HistoryEntry struct {
+	Value interface{}
+	At    time.Time
+}
+
+// History returns the execution results recorded by WithHistory for the given
+// key from the oldest, including the current one. It is nil if there are none.
+func (d *Dispatcher) History(key string) []HistoryEntry {
+	if d.checkKey(key) != nil {
+		return nil
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.history == nil {
+		return nil
+	}
+	return c.history.list()
+}
@@ -0,0 +1,22 @@
+package callcache
+
+import "time"
+
+// Leaser acquires leases shared among processes, such as with a distributed
+// store, so that only one of them refreshes a key at a time.
+type Leaser interface {
+	// AcquireLease reports whether the lease for key is acquired for ttl.
+	// It returns false while the lease is held by another process.
+	AcquireLease(key string, ttl time.Duration) (bool, error)
+}
+
+// leased reports whether c may be refreshed according to the Leaser set by
+// WithLeaser. If the Leaser fails, it is treated as acquired so that the
+// result keeps being refreshed.
+func (c *call) leased() bool {
+	if c.d.leaser == nil {
+		return true
+	}
+	ok, err := c.d.leaser.AcquireLease(c.key, time.Duration(c.d.leaseTTL))
+	return ok || err != nil
+}
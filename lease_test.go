@@ -0,0 +1,80 @@
+package callcache_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+type fakeLeaser struct {
+	mu     sync.Mutex
+	clock  *fakeClock
+	leases map[string]time.Time
+	err    error
+}
+
+func (l *fakeLeaser) AcquireLease(key string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return false, l.err
+	}
+	now := l.clock.Now()
+	if now.Before(l.leases[key]) {
+		return false, nil
+	}
+	l.leases[key] = now.Add(ttl)
+	return true, nil
+}
+
+func TestWithLeaser(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	leaser := &fakeLeaser{clock: clock, leases: make(map[string]time.Time)}
+
+	var mu sync.Mutex
+	calls := 0
+	fn := func() (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return "new", nil
+	}
+
+	dispatchers := make([]*callcache.Dispatcher, 3)
+	for i := range dispatchers {
+		dispatchers[i] = callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock), callcache.WithLeaser(leaser, 30*time.Second))
+		dispatchers[i].Set("key", "old")
+	}
+	clock.Add(2 * time.Minute)
+
+	want := []interface{}{"new", "old", "old"}
+	for i, dispatcher := range dispatchers {
+		if v, err := dispatcher.Do("key", fn); v != want[i] || err != nil {
+			t.Errorf("dispatchers[%d].Do() = %v, %v, want %v, nil", i, v, err, want[i])
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fn was called %d times, want 1", calls)
+	}
+
+	// Without a previous result, fn is called regardless of the lease.
+	if v, _ := dispatchers[1].Do("cold", fn); v != "new" {
+		t.Errorf("Do() of a cold key = %v, want new", v)
+	}
+
+	// The lease is acquired again after it expires.
+	clock.Add(1 * time.Minute)
+	if v, _ := dispatchers[2].Do("key", fn); v != "new" {
+		t.Errorf("Do() after the lease expired = %v, want new", v)
+	}
+
+	// Errors of the Leaser do not prevent refreshes.
+	leaser.err = errors.New("store is down")
+	clock.Add(2 * time.Minute)
+	if v, _ := dispatchers[1].Do("key", fn); v != "new" {
+		t.Errorf("Do() with a failing Leaser = %v, want new", v)
+	}
+}
@@ -0,0 +1,87 @@
+package callcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+)
+
+// Memoize returns a function that caches the results of fn in d for each
+// argument, which is formatted with %v as the key. Since the keys are shared
+// with the other calls of d, d should be dedicated to fn, or MemoizeKey should
+// be used with distinct keys.
+func Memoize[A comparable, R any](d *Dispatcher, fn func(A) (R, error)) func(A) (R, error) {
+	return MemoizeKey(d, func(a A) string { return fmt.Sprintf("%v", a) }, fn)
+}
+
+// MemoizeKey is like Memoize, but the key of each argument is built by key.
+func MemoizeKey[A any, R any](d *Dispatcher, key func(A) string, fn func(A) (R, error)) func(A) (R, error) {
+	return func(a A) (R, error) {
+		v, err := d.Do(key(a), func() (interface{}, error) {
+			return fn(a)
+		})
+		r, _ := v.(R)
+		return r, err
+	}
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// wrapped numbers the functions returned by Wrap to tell their keys apart.
+var wrapped int64
+
+// Wrap is like Memoize, but takes any function returning a value and an error,
+// and returns a function of the same type, using reflection instead of type
+// parameters for the functions of multiple arguments. It panics if fn is not
+// such a function. The key is a hash of the returned function, which is unique
+// to each call of Wrap, and the arguments formatted with %#v, so the arguments
+// are told apart by their values, except that pointers, funcs and channels are
+// told apart by their addresses rather than what they point to. Since the keys
+// are shared with the other calls of d, the result of a key stored by them,
+// such as by Set, is returned as an error wrapping ErrUnexpectedType unless it
+// is of the result type of fn. Each call has an extra cost of reflection and
+// formatting.
+func Wrap(d *Dispatcher, fn interface{}) interface{} {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumOut() != 2 || t.Out(1) != errorType {
+		panic(fmt.Sprintf("callcache: Wrap of %T, want a func returning a value and an error", fn))
+	}
+	id := atomic.AddInt64(&wrapped, 1)
+
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		h := sha256.New()
+		fmt.Fprintf(h, "%d %s\x00", id, t)
+		for _, arg := range args {
+			fmt.Fprintf(h, "%#v\x00", arg.Interface())
+		}
+		key := hex.EncodeToString(h.Sum(nil))
+
+		r, err := d.Do(key, func() (interface{}, error) {
+			var out []reflect.Value
+			if t.IsVariadic() {
+				out = v.CallSlice(args)
+			} else {
+				out = v.Call(args)
+			}
+			err, _ := out[1].Interface().(error)
+			return out[0].Interface(), err
+		})
+
+		out := reflect.New(t.Out(0)).Elem()
+		if rv := reflect.ValueOf(r); rv.IsValid() {
+			if rv.Type().AssignableTo(t.Out(0)) {
+				out.Set(rv)
+			} else if err == nil {
+				err = fmt.Errorf("%w %T for %q", ErrUnexpectedType, r, key)
+			}
+		}
+		errOut := reflect.Zero(errorType)
+		if err != nil {
+			errOut = reflect.ValueOf(&err).Elem()
+		}
+		return []reflect.Value{out, errOut}
+	}).Interface()
+}
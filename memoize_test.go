@@ -0,0 +1,154 @@
+package callcache_test
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestMemoize(t *testing.T) {
+	calls := make(map[int]int)
+	square := callcache.Memoize(callcache.NewDispatcher(1*time.Minute, 0), func(n int) (int, error) {
+		calls[n]++
+		return n * n, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		for n := 1; n <= 3; n++ {
+			if got, err := square(n); got != n*n || err != nil {
+				t.Errorf("square(%d) = %d, %v, want %d, nil", n, got, err, n*n)
+			}
+		}
+	}
+	for n := 1; n <= 3; n++ {
+		if calls[n] != 1 {
+			t.Errorf("fn(%d) was called %d times, want 1", n, calls[n])
+		}
+	}
+}
+
+func TestMemoizeKey(t *testing.T) {
+	type point struct{ x, y int }
+	errOrigin := errors.New("origin")
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	calls := 0
+	dist := callcache.MemoizeKey(dispatcher, func(p point) string {
+		return "dist/" + strconv.Itoa(p.x) + "," + strconv.Itoa(p.y)
+	}, func(p point) (float64, error) {
+		calls++
+		if p == (point{}) {
+			return 0, errOrigin
+		}
+		return float64(p.x*p.x + p.y*p.y), nil
+	})
+
+	dist(point{3, 4})
+	if got, err := dist(point{3, 4}); got != 25 || err != nil {
+		t.Errorf("dist() = %v, %v, want 25, nil", got, err)
+	}
+	if got, err := dist(point{}); got != 0 || err != errOrigin {
+		t.Errorf("dist() = %v, %v, want 0, %v", got, err, errOrigin)
+	}
+	if calls != 2 {
+		t.Errorf("fn was called %d times, want 2", calls)
+	}
+	if _, ok := dispatcher.Peek("dist/3,4"); !ok {
+		t.Error("Peek(dist/3,4) = false, want true")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	errNegative := errors.New("negative")
+	calls := 0
+	add := callcache.Wrap(callcache.NewDispatcher(1*time.Minute, 0), func(a, b int) (int, error) {
+		calls++
+		if a < 0 || b < 0 {
+			return 0, errNegative
+		}
+		return a + b, nil
+	}).(func(int, int) (int, error))
+
+	for i := 0; i < 3; i++ {
+		if got, err := add(1, 2); got != 3 || err != nil {
+			t.Errorf("add(1, 2) = %d, %v, want 3, nil", got, err)
+		}
+		if got, err := add(2, 1); got != 3 || err != nil {
+			t.Errorf("add(2, 1) = %d, %v, want 3, nil", got, err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("fn was called %d times, want 2", calls)
+	}
+	if got, err := add(-1, 2); got != 0 || err != errNegative {
+		t.Errorf("add(-1, 2) = %d, %v, want 0, %v", got, err, errNegative)
+	}
+}
+
+func TestWrap_variadic(t *testing.T) {
+	calls := 0
+	join := callcache.Wrap(callcache.NewDispatcher(1*time.Minute, 0), func(prefix string, ns ...int) (string, error) {
+		calls++
+		s := prefix
+		for _, n := range ns {
+			s += strconv.Itoa(n)
+		}
+		return s, nil
+	}).(func(string, ...int) (string, error))
+
+	for i := 0; i < 3; i++ {
+		if got, err := join("n", 1, 2); got != "n12" || err != nil {
+			t.Errorf("join(n, 1, 2) = %q, %v, want n12, nil", got, err)
+		}
+		if got, err := join("n", 12); got != "n12" || err != nil {
+			t.Errorf("join(n, 12) = %q, %v, want n12, nil", got, err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("fn was called %d times, want 2", calls)
+	}
+}
+
+func TestWrap_invalid(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Wrap() of a func without an error did not panic")
+		}
+	}()
+	callcache.Wrap(callcache.NewDispatcher(1*time.Minute, 0), func(n int) int { return n })
+}
+
+func TestWrap_sharedDispatcher(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	double := callcache.Wrap(dispatcher, func(n int) (int, error) { return n * 2, nil }).(func(int) (int, error))
+	triple := callcache.Wrap(dispatcher, func(n int) (int, error) { return n * 3, nil }).(func(int) (int, error))
+	name := callcache.Wrap(dispatcher, func(n int) (string, error) { return strconv.Itoa(n), nil }).(func(int) (string, error))
+
+	if got, err := double(1); got != 2 || err != nil {
+		t.Errorf("double(1) = %d, %v, want 2, nil", got, err)
+	}
+	if got, err := triple(1); got != 3 || err != nil {
+		t.Errorf("triple(1) = %d, %v, want 3, nil", got, err)
+	}
+	if got, err := name(1); got != "1" || err != nil {
+		t.Errorf("name(1) = %q, %v, want 1, nil", got, err)
+	}
+}
+
+func TestWrap_unexpectedType(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	name := callcache.Wrap(dispatcher, func(n int) (string, error) { return strconv.Itoa(n), nil }).(func(int) (string, error))
+	if _, err := name(1); err != nil {
+		t.Fatalf("name(1) error = %v", err)
+	}
+	// Overwrite the only key of name with a result of another type.
+	for _, key := range dispatcher.Keys() {
+		dispatcher.Set(key, 1)
+	}
+
+	if got, err := name(1); got != "" || !errors.Is(err, callcache.ErrUnexpectedType) {
+		t.Errorf("name(1) = %q, %v, want \"\", %v", got, err, callcache.ErrUnexpectedType)
+	}
+}
@@ -0,0 +1,58 @@
+package callcache
+
+import (
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// memoryPressure is the configuration of WithMemoryPressureEviction.
+type memoryPressure struct {
+	high, low uint64
+	check     time.Duration
+	// heapAlloc and gc are replaced by the tests.
+	heapAlloc func() uint64
+	gc        func()
+}
+
+func readHeapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// watchMemory runs evictUnderPressure every check until the Dispatcher is
+// closed.
+func (d *Dispatcher) watchMemory() {
+	d.reap(d.memory.check, d.evictUnderPressure)
+}
+
+// evictUnderPressure evicts the least recently used keys until the heap drops
+// to the low-water mark once it exceeds the high-water mark. Since the heap is
+// not freed until the garbage collection, each round evicts the share of the
+// keys that the excess accounts for in the heap, and then collects garbage
+// before measuring it again.
+func (d *Dispatcher) evictUnderPressure() {
+	m := d.memory
+	heap := m.heapAlloc()
+	if heap <= m.high {
+		return
+	}
+	for heap > m.low {
+		n := int64(math.Ceil(float64(atomic.LoadInt64(&d.entries)) * float64(heap-m.low) / float64(heap)))
+		evicted := int64(0)
+		for ; evicted < n; evicted++ {
+			victim := d.evictor.victim()
+			if victim == nil {
+				break
+			}
+			d.evict(victim, EvictMemory)
+		}
+		if evicted == 0 {
+			return
+		}
+		m.gc()
+		heap = m.heapAlloc()
+	}
+}
@@ -0,0 +1,47 @@
+package callcache
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithMemoryPressureEviction(t *testing.T) {
+	// Each key holds 1 KiB in the simulated heap.
+	const size = 1024
+	var gcs int
+	d := NewDispatcher(1*time.Minute, 0, WithMemoryPressureEviction(100*size, 60*size, time.Hour))
+	defer d.Close()
+	d.memory.heapAlloc = func() uint64 { return uint64(atomic.LoadInt64(&d.entries)) * size }
+	d.memory.gc = func() { gcs++ }
+
+	for i := 0; i < 100; i++ {
+		d.Set("key"+strconv.Itoa(i), i)
+	}
+	d.Do("key0", func() (interface{}, error) { return 0, nil })
+
+	// Not above the high-water mark.
+	d.evictUnderPressure()
+	if n := d.Len(); n != 100 {
+		t.Fatalf("Len() at the high-water mark = %d, want 100", n)
+	}
+
+	d.Set("key100", 100)
+	d.evictUnderPressure()
+	if n := d.Len(); n != 60 {
+		t.Errorf("Len() after the eviction = %d, want 60", n)
+	}
+	if gcs == 0 {
+		t.Error("no garbage collection while evicting")
+	}
+	// The least recently used keys are evicted.
+	for _, key := range []string{"key0", "key100"} {
+		if _, ok := d.Peek(key); !ok {
+			t.Errorf("%s is evicted", key)
+		}
+	}
+	if _, ok := d.Peek("key1"); ok {
+		t.Error("key1 is not evicted")
+	}
+}
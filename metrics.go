@@ -0,0 +1,35 @@
+package callcache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// WriteMetrics writes the Stats and Len of the Dispatcher to w in the
+// Prometheus text exposition format, so that it can be scraped without a
+// client library.
+func (d *Dispatcher) WriteMetrics(w io.Writer) error {
+	s := d.Stats()
+	metrics := []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"callcache_hits_total", "counter", "Number of calls that got a valid execution result.", s.Hits},
+		{"callcache_misses_total", "counter", "Number of calls that had to wait for an execution.", s.Misses},
+		{"callcache_executions_total", "counter", "Number of executions of fn.", s.Executions},
+		{"callcache_errors_total", "counter", "Number of executions of fn that returned an error.", s.Errors},
+		{"callcache_refreshes_total", "counter", "Number of updates launched in the background.", s.Refreshes},
+		{"callcache_removals_total", "counter", "Number of keys removed.", s.Removals},
+		{"callcache_leaders_total", "counter", "Number of calls that executed fn for the others waiting.", s.Leaders},
+		{"callcache_followers_total", "counter", "Number of calls that shared an execution by another.", s.Followers},
+		{"callcache_entries", "gauge", "Number of keys.", int64(d.Len())},
+	}
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,92 @@
+package callcache_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_WriteMetrics(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	dispatcher.Do("a", func() (interface{}, error) { return "value", nil })
+	dispatcher.Do("a", func() (interface{}, error) { return "value", nil })
+	dispatcher.Do("b", func() (interface{}, error) { return nil, errors.New("failed") })
+
+	// A follower shares the execution of c by the leader.
+	release := make(chan struct{})
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			dispatcher.Do("c", func() (interface{}, error) {
+				<-release
+				return "value", nil
+			})
+			done <- struct{}{}
+		}()
+	}
+	for dispatcher.Waiters("c") != 2 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	close(release)
+	<-done
+	<-done
+
+	var buf bytes.Buffer
+	if err := dispatcher.WriteMetrics(&buf); err != nil {
+		t.Fatalf("WriteMetrics() = %v, want nil", err)
+	}
+
+	comment := regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.+)$`)
+	sample := regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*) (-?[0-9]+)$`)
+	types := make(map[string]string)
+	values := make(map[string]int64)
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		line := sc.Text()
+		if m := comment.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				types[m[2]] = m[3]
+			}
+			continue
+		}
+		m := sample.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("invalid line %q", line)
+		}
+		if _, ok := types[m[1]]; !ok {
+			t.Errorf("sample %s has no preceding TYPE", m[1])
+		}
+		values[m[1]], _ = strconv.ParseInt(m[2], 10, 64)
+	}
+
+	want := map[string]int64{
+		"callcache_hits_total":       1,
+		"callcache_misses_total":     4,
+		"callcache_executions_total": 3,
+		"callcache_errors_total":     1,
+		"callcache_refreshes_total":  0,
+		"callcache_removals_total":   0,
+		"callcache_leaders_total":    3,
+		"callcache_followers_total":  1,
+		"callcache_entries":          3,
+	}
+	for name, v := range want {
+		if got, ok := values[name]; !ok || got != v {
+			t.Errorf("%s = %d (%v), want %d", name, got, ok, v)
+		}
+		wantType := "counter"
+		if !strings.HasSuffix(name, "_total") {
+			wantType = "gauge"
+		}
+		if types[name] != wantType {
+			t.Errorf("TYPE of %s = %s, want %s", name, types[name], wantType)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package callcache
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Namespace is a scope of keys to prevent the keys of different subsystems
+// sharing a Dispatcher from colliding.
+type Namespace string
+
+// Key returns the key composed of parts in ns. The composed keys never collide
+// with each other as long as either ns or parts are different, unless a key not
+// made by Key happens to be in the same format.
+func (ns Namespace) Key(parts ...string) string {
+	var b strings.Builder
+	b.WriteString(ns.prefix())
+	for _, part := range parts {
+		b.WriteString(strconv.Itoa(len(part)))
+		b.WriteByte(':')
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// prefix returns the prefix of all keys in ns. The length of ns makes it
+// unambiguous where ns ends.
+func (ns Namespace) prefix() string {
+	return strconv.Itoa(len(ns)) + ":" + string(ns) + "/"
+}
+
+// RemoveByPrefix removes the execution results of the keys starting with
+// prefix and returns the number of them. The keys replaced by WithKeyHasher are
+// matched as they are replaced.
+func (d *Dispatcher) RemoveByPrefix(prefix string) int {
+	return d.removeCalls(EvictRemoved, func(key string, _ *call) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// RemoveNamespace removes the execution results of the keys made by ns.Key and
+// returns the number of them.
+func (d *Dispatcher) RemoveNamespace(ns Namespace) int {
+	return d.RemoveByPrefix(ns.prefix())
+}
+
+// Clear removes all execution results, and clears the filter of
+// WithBloomFilter.
+func (d *Dispatcher) Clear() {
+	if d.bloom != nil {
+		// Reset before the removal so that no key stored afterwards is lost.
+		d.bloom.reset()
+	}
+	d.removeCalls(EvictRemoved, func(string, *call) bool {
+		return true
+	})
+}
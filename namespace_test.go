@@ -0,0 +1,44 @@
+package callcache_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func ExampleNamespace() {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second)
+	users := callcache.Namespace("users")
+	groups := callcache.Namespace("groups")
+
+	do := func(ns callcache.Namespace, id string) interface{} {
+		v, _ := dispatcher.Do(ns.Key(id), func() (interface{}, error) {
+			return string(ns) + "/" + id, nil
+		})
+		return v
+	}
+
+	fmt.Println(do(users, "1"))
+	fmt.Println(do(groups, "1"))
+
+	fmt.Println(dispatcher.RemoveNamespace(users))
+	fmt.Println(dispatcher.Keys())
+	// Output:
+	// users/1
+	// groups/1
+	// 1
+	// [6:groups/1:1]
+}
+
+func ExampleNamespace_Key() {
+	ns := callcache.Namespace("ns")
+
+	fmt.Println(ns.Key("a", "bc"))
+	fmt.Println(ns.Key("ab", "c"))
+	fmt.Println(callcache.Namespace("ns/1:a").Key())
+	// Output:
+	// 2:ns/1:a2:bc
+	// 2:ns/2:ab1:c
+	// 6:ns/1:a/
+}
@@ -0,0 +1,669 @@
+package callcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Option configures a Dispatcher.
+type Option func(*Dispatcher)
+
+// WithCircuitBreaker enables a circuit breaker for each key. After failures
+// consecutive errors, the breaker opens and fn is not called for cooldown;
+// instead, the last successful result and the last error are returned. Once
+// cooldown has elapsed, the next update is let through as a probe, which
+// closes the breaker on success and opens it again on failure.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.breakerFailures = failures
+		d.breakerCooldown = cooldown.Nanoseconds()
+	}
+}
+
+// WithQuarantine puts a key into quarantine after its fn returns an error
+// failures times in a row, where it is updated in the background no more often
+// than every interval, while the calls keep getting the previous result. The
+// first success takes the key out of the quarantine. Unlike WithCircuitBreaker,
+// the calls waiting for an execution are not affected. See Quarantined.
+func WithQuarantine(failures int, interval time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.quarantineFailures = failures
+		d.quarantineInterval = interval.Nanoseconds()
+	}
+}
+
+// WithResultValidator sets a function to validate the result of fn before it
+// is cached. If validator returns an error, the result is discarded and the
+// error is returned instead, as if fn had failed.
+func WithResultValidator(validator func(key string, v interface{}) error) Option {
+	return func(d *Dispatcher) {
+		d.validator = validator
+	}
+}
+
+// WithStaleOnError makes the Dispatcher return the last successful execution
+// result along with the error when fn returns an error, instead of the value
+// returned by fn. The result is nil if fn has never succeeded. It is the same
+// as WithErrorValuePolicy(LastGoodOnError).
+func WithStaleOnError() Option {
+	return WithErrorValuePolicy(LastGoodOnError)
+}
+
+// ErrorValuePolicy decides the value returned along with the error when fn
+// returns an error. See WithErrorValuePolicy.
+type ErrorValuePolicy int
+
+const (
+	// ReturnedOnError returns the value returned by fn along with the error,
+	// which is often nil.
+	ReturnedOnError ErrorValuePolicy = iota
+	// NilOnError always returns nil.
+	NilOnError
+	// LastGoodOnError returns the last successful execution result, or nil if
+	// fn has never succeeded.
+	LastGoodOnError
+)
+
+// WithErrorValuePolicy sets the policy of the value returned along with the
+// error when fn returns an error. The default is ReturnedOnError, as the
+// result of fn is returned as it is. It only decides what the callers waiting
+// for the execution get, since the value returned along with an error is not
+// cached except by DoPartial. It also applies to the last error returned by
+// WithCircuitBreaker without executing fn, along with which ReturnedOnError
+// returns the cached result as LastGoodOnError does. The errors telling that a
+// cached result is served instead, such as ErrStale and ErrFallback, are always
+// returned along with it.
+func WithErrorValuePolicy(policy ErrorValuePolicy) Option {
+	return func(d *Dispatcher) {
+		d.errorValue = policy
+	}
+}
+
+// WithKeyHasher sets a function to replace each key before it is used, such as
+// SHA256KeyHasher, to bound the memory and comparison cost of long keys.
+// Different keys that are replaced with the same one share the execution
+// result, and Keys returns the replaced keys.
+func WithKeyHasher(hasher func(key string) string) Option {
+	return func(d *Dispatcher) {
+		d.keyHasher = hasher
+	}
+}
+
+// SHA256KeyHasher returns a function for WithKeyHasher that replaces the keys
+// longer than maxLen with the hex encoded SHA-256 hash of them. Although a
+// collision of SHA-256 is astronomically unlikely, keys shorter than the hash
+// could collide with a hashed key if they look like one.
+func SHA256KeyHasher(maxLen int) func(key string) string {
+	return func(key string) string {
+		if len(key) <= maxLen {
+			return key
+		}
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+}
+
+// WithShardHasher sets the hash function to split the keys into the internal
+// shards, each of which has its own lock, instead of FNVShardHasher. A hash
+// function that distributes the keys unevenly makes the calls to the keys in
+// the same shard contend for the lock. The low bits of the hash are used.
+func WithShardHasher(hasher func(key string) uint64) Option {
+	return func(d *Dispatcher) {
+		d.shardHasher = hasher
+	}
+}
+
+// WithClock sets the Clock used to determine the freshness of the execution
+// results instead of the system clock. The elapsed time is measured by
+// time.Time.Sub, so it is not affected by adjustments of the wall clock as long
+// as clock returns the times with monotonic clock readings like time.Now.
+// Times going backwards are tolerated by treating the results updated in the
+// future as expired.
+func WithClock(clock Clock) Option {
+	return func(d *Dispatcher) {
+		d.clock = clock
+	}
+}
+
+// WithIdleTimeout removes the execution results of the keys that have not been
+// called for idleTimeout, regardless of their expiration. They are removed by
+// a background goroutine, which runs until Close is called, every half of
+// idleTimeout but no more often than every millisecond.
+func WithIdleTimeout(idleTimeout time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.idleTimeout = idleTimeout.Nanoseconds()
+	}
+}
+
+// WithReaperConcurrency sets the number of goroutines to remove idle keys for
+// WithIdleTimeout. The keys are split into shards, and each goroutine locks one
+// shard at a time, so that Do is not blocked by the whole sweep. The default is
+// 1.
+func WithReaperConcurrency(n int) Option {
+	return func(d *Dispatcher) {
+		if n > 0 {
+			d.reaperConcurrency = n
+		}
+	}
+}
+
+// WithExpiredReaping removes the expired execution results by RemoveExpired
+// every interval in a background goroutine, which runs until Close is called.
+// A non-positive interval is ignored.
+func WithExpiredReaping(interval time.Duration) Option {
+	return func(d *Dispatcher) {
+		if interval > 0 {
+			d.expiredInterval = interval
+		}
+	}
+}
+
+// WithMemoryPressureEviction evicts the least recently used keys, or the ones
+// chosen by WithEvictionPolicy, when the heap of the process exceeds high bytes
+// until it drops to low bytes, as a safety valve when the sizes of the results
+// are hard to predict. The heap is checked every check in a background
+// goroutine, which runs until Close is called, and measured by HeapAlloc of
+// runtime.MemStats, which stops the world briefly. Since the evicted results
+// are freed by the garbage collection, it is run by runtime.GC while evicting.
+// It is ignored unless high is positive, low is at most high, and check is
+// positive.
+func WithMemoryPressureEviction(high, low uint64, check time.Duration) Option {
+	return func(d *Dispatcher) {
+		if high == 0 || low > high || check <= 0 {
+			return
+		}
+		d.memory = &memoryPressure{
+			high:      high,
+			low:       low,
+			check:     check,
+			heapAlloc: readHeapAlloc,
+			gc:        runtime.GC,
+		}
+	}
+}
+
+// WithTransform adds a function to transform the execution result of fn into
+// the value to cache and return, such as a projection that is expensive to
+// compute at every call. It is called once for each execution of fn without an
+// error, and for each value given to Set and DoWithSeed, after
+// WithResultValidator. Multiple functions are applied in the order they are
+// added. The values copied from the cache, such as by Snapshot, Merge and
+// WithOverflowStore, are the transformed ones and are not transformed again.
+func WithTransform(fn func(v interface{}) interface{}) Option {
+	return func(d *Dispatcher) {
+		d.transforms = append(d.transforms, fn)
+	}
+}
+
+// WithBatchLoader makes the synchronous reloads of the expired results, which
+// would call fn for each key, wait for window to accumulate the keys reloaded
+// around the same time and call loader once with them instead, so that the
+// backend is queried once for several keys. Each caller blocks until loader
+// returns the result of its key, and an error of loader is returned to all of
+// them. A key missing from the results fails with ErrNotInBatch. The keys are
+// the ones stored with WithKeyHasher. With WithSerialExecutor, loader is
+// called on its goroutine, which is not occupied by the callers waiting for
+// the batch. The first loads of the keys, background refreshes and
+// ForceRefresh still call fn. It is ignored unless window is positive.
+func WithBatchLoader(window time.Duration, loader func(keys []string) (map[string]interface{}, error)) Option {
+	return func(d *Dispatcher) {
+		if window <= 0 {
+			return
+		}
+		d.batch = &batchLoader{window: window, load: loader, invoke: d.invoke}
+	}
+}
+
+// WithSettingsPropagation makes SetExpiration and SetUpdateInterval change the
+// existing keys as well as the keys created after that.
+func WithSettingsPropagation() Option {
+	return func(d *Dispatcher) {
+		d.propagate = true
+	}
+}
+
+// WithRefreshDoneHook sets a function called with the key after each update in
+// the background is completed, which is useful to synchronize tests.
+func WithRefreshDoneHook(hook func(key string)) Option {
+	return func(d *Dispatcher) {
+		d.refreshDone = hook
+	}
+}
+
+// WithWeakValues makes the Dispatcher hold the execution results weakly, so
+// that they can be garbage collected when nothing else refers to them. A
+// collected result is treated as expired and fn is executed again. Only
+// non-nil pointers to non-zero-sized values are held weakly, and the other
+// results are held as usual. It requires Go 1.24 or later; with older
+// versions, all results are held as usual.
+func WithWeakValues() Option {
+	return func(d *Dispatcher) {
+		d.weakValues = true
+	}
+}
+
+// WithStampedeObserver sets a function called when at least threshold callers
+// are waiting for the same key that has no execution result, such as after
+// Remove. concurrent is the number of the waiting callers when fn returns.
+func WithStampedeObserver(threshold int, observer func(key string, concurrent int)) Option {
+	return func(d *Dispatcher) {
+		d.stampede = threshold
+		d.stampedeFn = observer
+	}
+}
+
+// WithDebugStacks makes the Dispatcher record the stack trace of the first
+// execution of fn for each key, which can be obtained by DebugInfo. Capturing
+// stack traces is expensive, so it is intended for development only.
+func WithDebugStacks() Option {
+	return func(d *Dispatcher) {
+		d.debugStacks = true
+	}
+}
+
+// WithParallelRefresh makes the keys for which matcher returns true start a new
+// update even while another update of them is in flight, instead of sharing
+// the result of the update in flight. It lets the matched keys pick up newer
+// results sooner at the cost of more executions of fn.
+func WithParallelRefresh(matcher func(key string) bool) Option {
+	return func(d *Dispatcher) {
+		d.parallelRefresh = matcher
+	}
+}
+
+// WithRefreshGate sets a function that returns a sync.Locker to be held while fn
+// of the key is executed. Returning the same sync.Locker for multiple keys
+// serializes their executions of fn, and returning nil leaves them unlocked.
+func WithRefreshGate(gate func(key string) sync.Locker) Option {
+	return func(d *Dispatcher) {
+		d.refreshGate = gate
+	}
+}
+
+// WithResourceGroups serializes the executions of fn of the keys in the same
+// group returned by group, such as the ones accessing a rate-limited resource,
+// while the keys in different groups are executed concurrently. The keys in
+// the empty group are not serialized. It is a WithRefreshGate with a mutex for
+// each group, so it replaces WithRefreshGate and vice versa.
+func WithResourceGroups(group func(key string) string) Option {
+	g := &resourceGroups{group: group, lockers: make(map[string]*sync.Mutex)}
+	return WithRefreshGate(g.gate)
+}
+
+// WithAdaptiveTTL makes the expiration of each key adapt to how often its
+// result changes. The expiration starts at min, and each time an update
+// returns a result that equal reports to be the same as the previous one, it
+// is doubled up to max. Once the result changes, it is reset to min. It
+// overrides the expiration given to NewDispatcher.
+func WithAdaptiveTTL(min, max time.Duration, equal func(a, b interface{}) bool) Option {
+	return func(d *Dispatcher) {
+		d.adaptiveMin = min.Nanoseconds()
+		d.adaptiveMax = max.Nanoseconds()
+		d.adaptiveEqual = equal
+	}
+}
+
+// WithOnFirstLoad sets a function called with the first execution result of
+// each key, which is not called again when the result is updated. It is called
+// again only if the key is removed and then executed again.
+func WithOnFirstLoad(fn func(key string, v interface{})) Option {
+	return func(d *Dispatcher) {
+		d.onFirstLoad = fn
+	}
+}
+
+// WithMaxEntries limits the number of keys in the Dispatcher to maxEntries.
+// When a new key exceeds the limit, a key is evicted according to the
+// EvictionPolicy, which is LRU by default.
+func WithMaxEntries(maxEntries int) Option {
+	return func(d *Dispatcher) {
+		d.maxEntries = maxEntries
+	}
+}
+
+// WithOverflowStore makes the keys evicted by WithMaxEntries spilled to store
+// instead of being dropped. When a key has no result in the Dispatcher, it is
+// promoted from store if found there and not expired, before executing fn.
+// The keys removed in any other way are deleted from store.
+func WithOverflowStore(store Store) Option {
+	return func(d *Dispatcher) {
+		d.overflow = store
+	}
+}
+
+// WithEvictionPolicy sets the EvictionPolicy for WithMaxEntries.
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(d *Dispatcher) {
+		d.evictionPolicy = policy
+	}
+}
+
+// WithDiscardOnCancel makes DoContext discard the result of fn if ctx passed to
+// fn is canceled by the time fn returns, since the result may be incomplete.
+// The error of ctx is returned instead, and fn is executed again by the next
+// call.
+func WithDiscardOnCancel() Option {
+	return func(d *Dispatcher) {
+		d.discardOnCancel = true
+	}
+}
+
+// WithLeaderHandoff makes the callers waiting for fn executed by the caller of
+// DoContext whose ctx is done take over the execution, instead of getting the
+// error of fn, which may have been aborted by ctx. One of them whose ctx is not
+// done executes fn again with its own ctx, and the others wait for it.
+func WithLeaderHandoff() Option {
+	return func(d *Dispatcher) {
+		d.leaderHandoff = true
+	}
+}
+
+// WithReadOnly makes the Dispatcher never execute fn, such as on a read
+// replica that must not query the backend, while sharing the code populating
+// the cache. The results are served even after they have expired, and the keys
+// without a result fail with ErrNotCached. No refresh is started either in the
+// background or by ForceRefresh. The results are still stored by Set, Merge and
+// Import.
+func WithReadOnly() Option {
+	return func(d *Dispatcher) {
+		d.readOnly = true
+	}
+}
+
+// WithContextKeyExtractor sets a function that extracts a component of the key
+// from ctx given to DoContext, such as a locale. The same key with different
+// components is cached separately, so that a result for one context is never
+// served to another.
+func WithContextKeyExtractor(extract func(ctx context.Context) string) Option {
+	return func(d *Dispatcher) {
+		d.contextKey = extract
+	}
+}
+
+// WithAllowStale sets whether an expired result may be served. If allow is
+// false, which is the default, a call for an expired result waits for fn. If
+// allow is true, the expired result is returned while it is updated in the
+// background, unless there has never been a result.
+func WithAllowStale(allow bool) Option {
+	return func(d *Dispatcher) {
+		d.allowStale = allow
+	}
+}
+
+// WithMapGrowthObserver sets a function called with the number of keys each
+// time it reaches a power of two larger than ever before. Since the keys are
+// stored in maps that grow by doubling, it helps to correlate the latency with
+// the growth of the maps while warming up.
+func WithMapGrowthObserver(fn func(newSize int)) Option {
+	return func(d *Dispatcher) {
+		d.growthObserver = fn
+	}
+}
+
+// WithLeaser makes the Dispatcher acquire a lease for ttl from l before
+// updating a key that has a previous result. If the lease is held by another
+// process, the previous result is returned without calling fn, even if it has
+// expired. The first execution of each key does not need a lease.
+func WithLeaser(l Leaser, ttl time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.leaser = l
+		d.leaseTTL = ttl.Nanoseconds()
+	}
+}
+
+// WithOnEvict sets a function called with the key, the cached result, which is
+// nil if there is none, and the reason each time a key is removed from the
+// Dispatcher. Expired results are not removed by themselves, including by
+// Bump, so they are not reported until they are removed in any of the ways.
+func WithOnEvict(fn func(key string, v interface{}, reason EvictReason)) Option {
+	return func(d *Dispatcher) {
+		d.onEvict = fn
+	}
+}
+
+// WithRemoveAfterFailures removes a key after fn returns an error n times in a
+// row, such as when the resource behind it no longer exists, so that the next
+// call starts from scratch instead of serving an old result.
+func WithRemoveAfterFailures(n int) Option {
+	return func(d *Dispatcher) {
+		d.removeAfter = n
+	}
+}
+
+// WithMaxServeAge makes Do return ErrStale along with the cached result if it
+// is older than maxServeAge, which happens when the updates in the background
+// keep failing before the result expires.
+func WithMaxServeAge(maxServeAge time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.maxServeAge = maxServeAge.Nanoseconds()
+	}
+}
+
+// WithFreezeCheck makes the Dispatcher call fn with the key each time a cached
+// result is found to have been mutated since it was stored, such as a slice
+// modified by fn after returning it. The result is compared by a hash of its
+// content printed by fmt at every hit, so it is intended for tests only.
+func WithFreezeCheck(fn func(key string)) Option {
+	return func(d *Dispatcher) {
+		d.freezeCheck = fn
+	}
+}
+
+// WithConsistencyCheck makes the Dispatcher call fn with the key when the
+// callers of DoWithFingerprint waiting for the same execution give different
+// fingerprints, which means that their functions would compute different
+// results although only the one of the first caller is executed. It is given
+// the fingerprint of the first caller and the one of another. The fingerprints
+// must be comparable.
+func WithConsistencyCheck(fn func(key string, leader, follower interface{})) Option {
+	return func(d *Dispatcher) {
+		d.consistencyCheck = fn
+	}
+}
+
+type emptyKeyMode int
+
+const (
+	emptyKeyAllow emptyKeyMode = iota
+	emptyKeyReject
+	emptyKeyPanic
+)
+
+// WithRejectEmptyKey makes the Dispatcher reject the empty key, which usually
+// means that building the key has been forgotten. The methods with an error
+// result return ErrEmptyKey for it, and the others ignore it, such as Remove
+// and Peek. If panics is true, all of them panic with ErrEmptyKey instead.
+func WithRejectEmptyKey(panics bool) Option {
+	return func(d *Dispatcher) {
+		d.emptyKey = emptyKeyReject
+		if panics {
+			d.emptyKey = emptyKeyPanic
+		}
+	}
+}
+
+// WithBatchedEvents makes the Dispatcher deliver the events of the keys to fn
+// in batches, each time maxBatch events are buffered or flushInterval elapses,
+// instead of calling a function for each of them. If flushInterval is not
+// positive, the events are only delivered by maxBatch. The rest of the events
+// are delivered when the Dispatcher is closed.
+func WithBatchedEvents(flushInterval time.Duration, maxBatch int, fn func([]Event)) Option {
+	return func(d *Dispatcher) {
+		d.events = &eventBatcher{maxBatch: maxBatch, deliver: fn}
+		d.eventsInterval = flushInterval
+	}
+}
+
+// WithErrorHistory makes the Dispatcher record the last n errors returned by
+// fn for each key, which can be obtained by Errors. The errors are recorded
+// even if a stale result is served instead of them.
+func WithErrorHistory(n int) Option {
+	return func(d *Dispatcher) {
+		d.errorHistory = n
+	}
+}
+
+// WithMaxConcurrentLoads limits the number of the concurrent executions of fn
+// that callers wait for to n across all keys, which prevents a flood of cold
+// keys from overwhelming the backend. The executions in the background are not
+// limited. When the limit is reached, the executions wait for a slot, or
+// ErrTooManyLoads is returned if failFast is true. n less than 1 is ignored,
+// and the executions are not limited.
+func WithMaxConcurrentLoads(n int, failFast bool) Option {
+	return func(d *Dispatcher) {
+		if n > 0 {
+			d.loads = make(chan struct{}, n)
+			d.loadsFailFast = failFast
+		}
+	}
+}
+
+// WithValuePool makes the Dispatcher cache a copy of each execution result in
+// a value obtained from a pool, and put the cached value back to the pool after
+// resetting it with resetFn when it is replaced by an update. newFn creates a
+// value when the pool is empty. copyFn copies src into dst and returns it, or
+// into a new value if dst is nil like append. Since a pooled value is reused,
+// it is never returned to a caller, who gets a new copy of it instead. Pointer
+// types should be used to avoid allocating when they are put back to the
+// pool. It cannot be used with WithWeakValues.
+func WithValuePool(newFn func() interface{}, resetFn func(interface{}), copyFn func(dst, src interface{}) interface{}) Option {
+	return func(d *Dispatcher) {
+		d.valuePool = &valuePool{
+			pool:  sync.Pool{New: newFn},
+			reset: resetFn,
+			copy:  copyFn,
+		}
+	}
+}
+
+// WithSerialExecutor makes the Dispatcher execute fn of all keys one by one on
+// a single goroutine, such as for a client that is not safe for concurrent use.
+// The executions for the same key are still deduplicated. Once the Dispatcher
+// is closed, ErrClosed is returned instead of executing fn.
+func WithSerialExecutor() Option {
+	return func(d *Dispatcher) {
+		d.serial = make(chan serialJob)
+	}
+}
+
+// WithCardinalityWarning makes the Dispatcher call fn with the rate of new keys
+// per second if it is at least minRate while hardly any call hits a cached
+// result, which usually means that the keys contain something unique to each
+// call, such as a timestamp. The rate is measured over every 10 seconds.
+func WithCardinalityWarning(minRate float64, fn func(ratePerSec float64)) Option {
+	return func(d *Dispatcher) {
+		d.cardinalityRate = minRate
+		d.cardinalityFn = fn
+	}
+}
+
+// WithRemoveTombstone makes Remove keep the key tombstoned for grace, during
+// which the execution results of the key are returned but not cached. Without
+// it, an execution of fn that started before Remove may cache the result based
+// on the state before the removal, such as when joining an execution shared by
+// DoShared. The keys removed by Take, Handle.Remove and InvalidateTag are
+// tombstoned as well.
+func WithRemoveTombstone(grace time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.tombstoneGrace = grace.Nanoseconds()
+	}
+}
+
+// WithKeyValidator sets a function that validates each key given to the
+// Dispatcher, such as whether it matches the expected format. The keys for
+// which validator returns an error are rejected in the same way as
+// WithRejectEmptyKey, with ErrInvalidKey wrapping the error.
+func WithKeyValidator(validator func(key string) error) Option {
+	return func(d *Dispatcher) {
+		d.keyValidator = validator
+	}
+}
+
+// WithMinRefreshInterval makes the Dispatcher execute fn of each key at most
+// once per interval, whether it succeeds or fails, even if the key is removed
+// in between. Until the interval elapses, the previous result is returned even
+// if it has expired, or ErrRateLimited if there is none.
+func WithMinRefreshInterval(interval time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.minRefreshInterval = interval.Nanoseconds()
+	}
+}
+
+// WithStartupJitter delays the first refresh of each key in the background
+// after its updateInterval by a random duration less than max, so that the
+// keys warmed up together at startup are not refreshed all at once. The delay
+// is dropped once the key is updated again, whether in the background or by a
+// synchronous reload of an expired result, which is never delayed, so the later
+// refreshes are not delayed. The remaining delay is reported by Config. It is
+// ignored unless max is positive.
+func WithStartupJitter(max time.Duration) Option {
+	return func(d *Dispatcher) {
+		if max > 0 {
+			d.startupJitter = max.Nanoseconds()
+		}
+	}
+}
+
+// WithHistory makes the Dispatcher record the last n execution results of each
+// key, which can be obtained by History for debugging. Only the latest one is
+// returned by Do.
+func WithHistory(n int) Option {
+	return func(d *Dispatcher) {
+		d.historySize = n
+	}
+}
+
+// WithMaxConcurrentRefreshes limits the number of the concurrent updates in
+// the background to n. The others are queued, and the ones whose results
+// expire sooner are updated first, so that a key is not left to expire while
+// waiting behind the others. n less than 1 is ignored, and the updates are not
+// limited.
+func WithMaxConcurrentRefreshes(n int) Option {
+	return func(d *Dispatcher) {
+		if n > 0 {
+			d.scheduler = newScheduler(n)
+		}
+	}
+}
+
+// WithGroupLimit limits the number of the concurrent jobs of DoGroupCtx to n.
+// The rest wait to be started until one of the running jobs finishes.
+func WithGroupLimit(n int) Option {
+	return func(d *Dispatcher) {
+		d.groupLimit = n
+	}
+}
+
+// WithGroupContinueOnError makes DoGroupCtx run all of the jobs even after one
+// of them fails, instead of canceling the others. The first error is still
+// returned.
+func WithGroupContinueOnError() Option {
+	return func(d *Dispatcher) {
+		d.groupContinue = true
+	}
+}
+
+// WithMaxTotalAge limits how long the results of each key are kept since they
+// were first stored, however many times they are updated in the background.
+// Once maxAge has elapsed, the results are treated as expired even with
+// WithAllowStale, and the next call executes fn synchronously as if the key
+// was new.
+func WithMaxTotalAge(maxAge time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.maxTotalAge = maxAge.Nanoseconds()
+	}
+}
+
+// WithBloomFilter makes MayContain answer by a bloom filter sized for n keys
+// with the false positive rate p, instead of looking up the key. The filter
+// is updated when a key first gets an execution result and cleared by Clear,
+// so the rate grows if more than n keys are stored in between.
+func WithBloomFilter(n int, p float64) Option {
+	return func(d *Dispatcher) {
+		d.bloom = newBloomFilter(n, p)
+	}
+}
@@ -0,0 +1,55 @@
+package callcache
+
+// Store is a slower tier of the execution results, such as on disk, to which
+// the keys evicted by WithMaxEntries or WithMemoryPressureEviction are spilled.
+// See WithOverflowStore.
+type Store interface {
+	// Get returns the entry of key, and false if there is no such key.
+	Get(key string) (SnapshotEntry, bool, error)
+	// Set stores the entry of key.
+	Set(key string, e SnapshotEntry) error
+	// Delete deletes the entry of key if any.
+	Delete(key string) error
+}
+
+// spill writes the result of c evicted by WithMaxEntries to the Store set by
+// WithOverflowStore. A failure to write is ignored, and the result is just
+// dropped as it would be without the Store.
+func (d *Dispatcher) spill(c *call) {
+	c.mu.RLock()
+	v, ok := c.value()
+	at := c.lastUpdate
+	c.mu.RUnlock()
+	if ok {
+		_ = d.overflow.Set(c.key, SnapshotEntry{Value: v, LastUpdate: at})
+	}
+}
+
+// promote loads the result of c from the Store set by WithOverflowStore and
+// reports whether it is found and has not expired. The result keeps the time
+// it was updated, so being spilled does not extend it.
+func (c *call) promote() (interface{}, bool) {
+	e, ok, err := c.d.overflow.Get(c.key)
+	if err != nil || !ok {
+		return nil, false
+	}
+	expiration, _ := c.timing()
+	if t := c.d.clock.Now().Sub(e.LastUpdate); t < 0 || int64(t) > expiration {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	if c.loaded {
+		// Loaded by Set in the meantime.
+		v, ok := c.value()
+		c.mu.Unlock()
+		return v, ok
+	}
+	first := c.store(e.Value, e.LastUpdate)
+	v, _ := c.value()
+	c.mu.Unlock()
+	if first {
+		c.firstLoaded(v)
+	}
+	return v, true
+}
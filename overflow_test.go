@@ -0,0 +1,89 @@
+package callcache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+type mapStore struct {
+	mu      sync.Mutex
+	entries map[string]callcache.SnapshotEntry
+}
+
+func (s *mapStore) Get(key string) (callcache.SnapshotEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	return e, ok, nil
+}
+
+func (s *mapStore) Set(key string, e callcache.SnapshotEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = e
+	return nil
+}
+
+func (s *mapStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func TestWithOverflowStore(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	store := &mapStore{entries: make(map[string]callcache.SnapshotEntry)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+		callcache.WithClock(clock),
+		callcache.WithMaxEntries(2),
+		callcache.WithOverflowStore(store),
+	)
+
+	calls := make(map[string]int)
+	do := func(key string) interface{} {
+		v, _ := dispatcher.Do(key, func() (interface{}, error) {
+			calls[key]++
+			return key + "-value", nil
+		})
+		return v
+	}
+
+	do("a")
+	clock.Add(10 * time.Second)
+	do("b")
+	do("c")
+	if e, ok := store.entries["a"]; !ok || e.Value != "a-value" || !e.LastUpdate.Equal(start) {
+		t.Fatalf("spilled entry of a = %+v, %v, want {a-value %v}, true", e, ok, start)
+	}
+	if _, ok := dispatcher.Peek("a"); ok {
+		t.Error("a is still in the Dispatcher after eviction")
+	}
+
+	// a is promoted, which evicts b.
+	if v := do("a"); v != "a-value" || calls["a"] != 1 {
+		t.Errorf("Do(a) = %v with %d calls, want a-value with 1 call", v, calls["a"])
+	}
+	if _, ok := store.entries["b"]; !ok {
+		t.Error("b was not spilled")
+	}
+
+	// A spilled result still expires from its last update.
+	clock.Add(50*time.Second + 1)
+	if v := do("b"); v != "b-value" || calls["b"] != 1 {
+		t.Errorf("Do(b) = %v with %d calls, want b-value with 1 call", v, calls["b"])
+	}
+	do("c")
+	if v := do("a"); v != "a-value" || calls["a"] != 2 {
+		t.Errorf("Do(a) after expiration = %v with %d calls, want a-value with 2 calls", v, calls["a"])
+	}
+
+	dispatcher.Remove("a")
+	if _, ok := store.entries["a"]; ok {
+		t.Error("a is still in the store after Remove")
+	}
+}
@@ -0,0 +1,60 @@
+package callcache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrPanicked is returned by DoPartial when fn panics, wrapping the value it
+// panicked with.
+var ErrPanicked = errors.New("callcache: fn panicked")
+
+// DoPartial is like Do, but fn emits the intermediate results as it makes
+// progress, and the last one is the execution result. If fn returns an error
+// or panics after emitting any, the last emitted result is still cached as
+// best effort and returned along with the error, which wraps ErrPanicked for
+// a panic.
+func (d *Dispatcher) DoPartial(key string, fn func(emit func(interface{})) error) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	return d.call(key).do(work{fn: func() (interface{}, error) {
+		p := &partial{}
+		err := p.run(fn)
+		v, ok := p.result()
+		// The partial result is cached by execute in the same way as the
+		// others, such as after WithResultValidator.
+		return annotated{v: v, keep: ok}, err
+	}})
+}
+
+// partial holds the last result emitted by fn of DoPartial, which may be
+// emitted from other goroutines.
+type partial struct {
+	mu      sync.Mutex
+	v       interface{}
+	emitted bool
+}
+
+func (p *partial) emit(v interface{}) {
+	p.mu.Lock()
+	p.v, p.emitted = v, true
+	p.mu.Unlock()
+}
+
+func (p *partial) result() (interface{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.v, p.emitted
+}
+
+// run calls fn and recovers from its panic.
+func (p *partial) run(fn func(emit func(interface{})) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrPanicked, r)
+		}
+	}()
+	return fn(p.emit)
+}
@@ -0,0 +1,102 @@
+package callcache_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_DoPartial(t *testing.T) {
+	errStep := errors.New("step failed")
+
+	tests := []struct {
+		name    string
+		fn      func(emit func(interface{})) error
+		want    interface{}
+		wantErr error
+		cached  bool
+	}{
+		{
+			name: "complete",
+			fn: func(emit func(interface{})) error {
+				emit("step1")
+				emit("step2")
+				return nil
+			},
+			want:   "step2",
+			cached: true,
+		},
+		{
+			name: "error after emit",
+			fn: func(emit func(interface{})) error {
+				emit("step1")
+				return errStep
+			},
+			want:    "step1",
+			wantErr: errStep,
+			cached:  true,
+		},
+		{
+			name: "panic after emit",
+			fn: func(emit func(interface{})) error {
+				emit("step1")
+				panic("boom")
+			},
+			want:    "step1",
+			wantErr: callcache.ErrPanicked,
+			cached:  true,
+		},
+		{
+			name: "error without emit",
+			fn: func(emit func(interface{})) error {
+				return errStep
+			},
+			wantErr: errStep,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+			v, err := dispatcher.DoPartial("key", tt.fn)
+			if v != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("DoPartial() = %v, %v, want %v, %v", v, err, tt.want, tt.wantErr)
+			}
+
+			calls := 0
+			v, err = dispatcher.Do("key", func() (interface{}, error) {
+				calls++
+				return "fresh", nil
+			})
+			if tt.cached && (v != tt.want || err != nil || calls != 0) {
+				t.Errorf("Do() = %v, %v with %d calls, want the cached %v", v, err, calls, tt.want)
+			}
+			if !tt.cached && calls != 1 {
+				t.Errorf("Do() called fn %d times, want 1", calls)
+			}
+		})
+	}
+}
+
+func TestDispatcher_DoPartial_validator(t *testing.T) {
+	errStep := errors.New("step failed")
+	errRejected := errors.New("rejected")
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithResultValidator(func(key string, v interface{}) error {
+		if v == "invalid" {
+			return errRejected
+		}
+		return nil
+	}))
+
+	v, err := dispatcher.DoPartial("key", func(emit func(interface{})) error {
+		emit("invalid")
+		return errStep
+	})
+	if v != nil || err != errStep {
+		t.Errorf("DoPartial() = %v, %v, want nil, %v", v, err, errStep)
+	}
+	if v, ok := dispatcher.Peek("key"); ok {
+		t.Errorf("Peek() = %v, true, want the rejected result not cached", v)
+	}
+}
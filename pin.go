@@ -0,0 +1,41 @@
+package callcache
+
+import "sync/atomic"
+
+// Pin exempts the given key from the removals made by the Dispatcher itself,
+// such as by WithMaxEntries, WithIdleTimeout, WithRemoveAfterFailures and
+// RemoveExpired, while it is still updated as usual and removed by Remove and
+// the like. The pinned keys do not count against the limit of WithMaxEntries.
+// The key is pinned even before it has a result, and the pin is dropped when
+// it is removed.
+func (d *Dispatcher) Pin(key string) {
+	if d.checkKey(key) != nil {
+		return
+	}
+	// A new key is created pinned, since admitting it first would evict
+	// another key at the limit.
+	c := d.loadOrCreate(d.hashKey(key), true)
+	atomic.StoreInt32(&c.pinned, 1)
+	if d.evictor != nil {
+		d.evictor.pin(c)
+	}
+}
+
+// Unpin undoes Pin of the given key, after which it is counted against the
+// limit of WithMaxEntries as the most recently used key.
+func (d *Dispatcher) Unpin(key string) {
+	if d.checkKey(key) != nil {
+		return
+	}
+	c := d.lookup(key)
+	if c == nil || !atomic.CompareAndSwapInt32(&c.pinned, 1, 0) {
+		return
+	}
+	if d.evictor != nil {
+		d.admit(c)
+	}
+}
+
+func (c *call) isPinned() bool {
+	return atomic.LoadInt32(&c.pinned) != 0
+}
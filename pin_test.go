@@ -0,0 +1,93 @@
+package callcache_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_Pin(t *testing.T) {
+	for _, policy := range []callcache.EvictionPolicy{callcache.LRU, callcache.SLRU} {
+		t.Run(fmt.Sprint(policy), func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+				callcache.WithMaxEntries(10),
+				callcache.WithEvictionPolicy(policy),
+			)
+			fn := func() (interface{}, error) {
+				return "value", nil
+			}
+
+			dispatcher.Pin("base")
+			dispatcher.Do("base", fn)
+			for i := 0; i < 100; i++ {
+				dispatcher.Do(fmt.Sprintf("key%d", i), fn)
+			}
+			if _, ok := dispatcher.Peek("base"); !ok {
+				t.Error("pinned key was evicted")
+			}
+			// The pinned key does not count against the limit.
+			if n := dispatcher.Len(); n != 11 {
+				t.Errorf("Len() = %d, want 11", n)
+			}
+
+			dispatcher.Unpin("base")
+			if n := dispatcher.Len(); n != 10 {
+				t.Errorf("Len() after Unpin() = %d, want 10", n)
+			}
+			for i := 100; i < 120; i++ {
+				dispatcher.Do(fmt.Sprintf("key%d", i), fn)
+			}
+			if _, ok := dispatcher.Peek("base"); ok {
+				t.Error("unpinned key was not evicted")
+			}
+		})
+	}
+}
+
+func TestDispatcher_Pin_atCapacity(t *testing.T) {
+	for _, policy := range []callcache.EvictionPolicy{callcache.LRU, callcache.SLRU} {
+		t.Run(fmt.Sprint(policy), func(t *testing.T) {
+			var evicted []string
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+				callcache.WithMaxEntries(2),
+				callcache.WithEvictionPolicy(policy),
+				callcache.WithOnEvict(func(key string, _ interface{}, _ callcache.EvictReason) {
+					evicted = append(evicted, key)
+				}),
+			)
+			dispatcher.Set("a", "value")
+			dispatcher.Set("b", "value")
+
+			dispatcher.Pin("p")
+			if len(evicted) != 0 {
+				t.Errorf("Pin() of a new key evicted %v, want none", evicted)
+			}
+			if n := dispatcher.Len(); n != 3 {
+				t.Errorf("Len() = %d, want 3", n)
+			}
+		})
+	}
+}
+
+func TestDispatcher_Pin_reaper(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Nanosecond, 0, callcache.WithIdleTimeout(1*time.Millisecond))
+	defer dispatcher.Close()
+
+	dispatcher.Pin("pinned")
+	dispatcher.Set("pinned", "value")
+	dispatcher.Set("other", "value")
+	time.Sleep(20 * time.Millisecond)
+	dispatcher.RemoveExpired()
+
+	if keys := dispatcher.Keys(); len(keys) != 1 || keys[0] != "pinned" {
+		t.Errorf("Keys() = %v, want [pinned]", keys)
+	}
+
+	// The pinned key is still removed explicitly.
+	dispatcher.Remove("pinned")
+	if n := dispatcher.Len(); n != 0 {
+		t.Errorf("Len() after Remove() = %d, want 0", n)
+	}
+}
@@ -0,0 +1,21 @@
+package callcache
+
+import "sync"
+
+// valuePool recycles the cached results set by WithValuePool.
+type valuePool struct {
+	pool  sync.Pool
+	reset func(interface{})
+	copy  func(dst, src interface{}) interface{}
+}
+
+// hold returns a copy of v in a pooled value to be cached.
+func (p *valuePool) hold(v interface{}) interface{} {
+	return p.copy(p.pool.Get(), v)
+}
+
+// recycle resets v, which is no longer cached, and puts it back to the pool.
+func (p *valuePool) recycle(v interface{}) {
+	p.reset(v)
+	p.pool.Put(v)
+}
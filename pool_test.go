@@ -0,0 +1,66 @@
+package callcache_test
+
+import (
+	"bytes"
+	"runtime/debug"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithValuePool(t *testing.T) {
+	// Keep the pool from being cleared by GC during the test.
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var allocated, recycled int
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+		callcache.WithClock(clock),
+		callcache.WithValuePool(
+			func() interface{} {
+				allocated++
+				return new(bytes.Buffer)
+			},
+			func(v interface{}) {
+				recycled++
+				v.(*bytes.Buffer).Reset()
+			},
+			func(dst, src interface{}) interface{} {
+				b, _ := dst.(*bytes.Buffer)
+				if b == nil {
+					b = new(bytes.Buffer)
+				}
+				b.Write(src.(*bytes.Buffer).Bytes())
+				return b
+			},
+		),
+	)
+
+	const refreshes = 10
+	var copies []interface{}
+	for i := 0; i < refreshes; i++ {
+		fn := func() (interface{}, error) {
+			return bytes.NewBufferString("value " + strconv.Itoa(i)), nil
+		}
+		dispatcher.Do("key", fn)
+		v, _ := dispatcher.Do("key", fn)
+		copies = append(copies, v)
+		clock.Add(2 * time.Minute)
+	}
+
+	// Only the current and the previous cached values need to be allocated,
+	// although sync.Pool randomly drops values with the race detector.
+	if allocated >= refreshes {
+		t.Errorf("%d values were allocated by the pool, want fewer than %d", allocated, refreshes)
+	}
+	if recycled != refreshes-1 {
+		t.Errorf("%d values were recycled, want %d", recycled, refreshes-1)
+	}
+	for i, v := range copies {
+		if got, want := v.(*bytes.Buffer).String(), "value "+strconv.Itoa(i); got != want {
+			t.Errorf("copies[%d] = %q, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package callcache
+
+import (
+	"sort"
+	"time"
+)
+
+// quarantined reports whether the updates of c in the background are held
+// back by WithQuarantine at now.
+func (c *call) quarantined(now time.Time) bool {
+	if c.d.quarantineFailures <= 0 {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.failures >= c.d.quarantineFailures && now.Sub(c.errorAt) < time.Duration(c.d.quarantineInterval)
+}
+
+// Quarantined returns the sorted keys in the quarantine of WithQuarantine,
+// which have failed too many times in a row.
+func (d *Dispatcher) Quarantined() []string {
+	if d.quarantineFailures <= 0 {
+		return nil
+	}
+	var keys []string
+	d.rangeCalls(func(key string, c *call) {
+		c.mu.RLock()
+		if c.failures >= d.quarantineFailures {
+			keys = append(keys, key)
+		}
+		c.mu.RUnlock()
+	})
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,71 @@
+package callcache_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithQuarantine(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	refreshed := make(chan struct{}, 1)
+	dispatcher := callcache.NewDispatcher(1*time.Hour, 1*time.Minute,
+		callcache.WithClock(clock),
+		callcache.WithQuarantine(2, 10*time.Minute),
+		callcache.WithRefreshDoneHook(func(string) { refreshed <- struct{}{} }),
+	)
+	ok := func() (interface{}, error) { return "v", nil }
+	failing := func() (interface{}, error) { return nil, errors.New("backend is down") }
+	dispatcher.Do("key", ok)
+
+	// call calls Do after the update interval and reports whether the key was
+	// refreshed.
+	call := func(fn func() (interface{}, error)) bool {
+		clock.Add(1*time.Minute + 1)
+		if v, _ := dispatcher.Do("key", fn); v != "v" {
+			t.Errorf("Do() = %v, want v", v)
+		}
+		select {
+		case <-refreshed:
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if !call(failing) {
+			t.Errorf("failure #%d was not refreshed", i+1)
+		}
+	}
+	if keys := dispatcher.Quarantined(); fmt.Sprint(keys) != "[key]" {
+		t.Errorf("Quarantined() = %v, want [key]", keys)
+	}
+
+	// Within the quarantine interval since the last failure.
+	for i := 0; i < 9; i++ {
+		if call(failing) {
+			t.Errorf("refreshed %v after the last failure in quarantine", time.Duration(i+1)*time.Minute)
+		}
+	}
+	if !call(failing) {
+		t.Error("not refreshed after the quarantine interval")
+	}
+	if call(ok) {
+		t.Error("refreshed right after the failure in quarantine")
+	}
+
+	clock.Add(10 * time.Minute)
+	if !call(ok) {
+		t.Error("not refreshed after the quarantine interval")
+	}
+	if keys := dispatcher.Quarantined(); len(keys) != 0 {
+		t.Errorf("Quarantined() after a success = %v, want []", keys)
+	}
+	if !call(ok) {
+		t.Error("not refreshed after graduating from the quarantine")
+	}
+}
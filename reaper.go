@@ -0,0 +1,78 @@
+package callcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minReapInterval is the shortest interval of the sweeps for WithIdleTimeout,
+// which keeps a tiny idleTimeout from spinning the reaper.
+const minReapInterval = time.Millisecond
+
+// reapInterval returns the interval of the sweeps for idleTimeout.
+func reapInterval(idleTimeout time.Duration) time.Duration {
+	if interval := idleTimeout / 2; interval > minReapInterval {
+		return interval
+	}
+	return minReapInterval
+}
+
+// reap calls sweep every interval until the Dispatcher is closed.
+func (d *Dispatcher) reap(interval time.Duration, sweep func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			sweep()
+		}
+	}
+}
+
+// removeIdle removes idle calls by sweeping the shards with the configured
+// number of goroutines. Each shard is locked only while it is swept.
+func (d *Dispatcher) removeIdle() {
+	now := d.sinceEpoch(d.clock.Now())
+	idle := func(_ string, c *call) bool {
+		return now-atomic.LoadInt64(&c.lastAccess) > d.idleTimeout && !c.isPinned()
+	}
+
+	shards := make(chan *shard, len(d.shards))
+	for _, s := range d.shards {
+		shards <- s
+	}
+	close(shards)
+
+	var wg sync.WaitGroup
+	for i := 0; i < d.reaperConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range shards {
+				d.removeShardCalls(s, EvictIdle, idle)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// RemoveExpired removes the keys whose execution results have expired, such as
+// those served by WithAllowStale or outdated by Bump, and returns the number
+// of them. The keys without a result yet are kept, as are the keys being
+// executed, which store their results again, and the keys pinned by Pin. The
+// removed keys are given to the function set by WithOnEvict with EvictExpired.
+func (d *Dispatcher) RemoveExpired() int {
+	now := d.clock.Now()
+	return d.removeCalls(EvictExpired, func(_ string, c *call) bool {
+		if atomic.LoadInt64(&c.waiters) > 0 || c.isPinned() {
+			return false
+		}
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return c.loaded && c.age(now) > c.ttl()
+	})
+}
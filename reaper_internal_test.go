@@ -0,0 +1,95 @@
+package callcache
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func BenchmarkDispatcher_Do_duringSweep(b *testing.B) {
+	const size = 100000
+
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("concurrency=%d", n), func(b *testing.B) {
+			d := NewDispatcher(1*time.Minute, 0, WithIdleTimeout(1*time.Hour), WithReaperConcurrency(n))
+			defer d.Close()
+
+			fn := func() (interface{}, error) {
+				return "value", nil
+			}
+			keys := make([]string, size)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key%d", i)
+				d.Do(keys[i], fn)
+			}
+
+			done := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						d.removeIdle()
+					}
+				}
+			}()
+
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				d.Do(keys[i%size], fn)
+				latencies[i] = time.Since(start)
+			}
+			b.StopTimer()
+			close(done)
+			<-stopped
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+		})
+	}
+}
+
+// stepClock is a Clock whose time is advanced manually.
+type stepClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *stepClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestWithIdleTimeout_set(t *testing.T) {
+	clock := &stepClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	d := NewDispatcher(1*time.Hour, 0, WithClock(clock), WithIdleTimeout(1*time.Minute))
+	defer d.Close()
+
+	// The keys created long after the Dispatcher are not idle.
+	clock.Add(2 * time.Minute)
+	d.Set("set", "value")
+	d.removeIdle()
+	if _, ok := d.Peek("set"); !ok {
+		t.Error("the key set right before the sweep was removed")
+	}
+
+	clock.Add(2 * time.Minute)
+	d.removeIdle()
+	if n := d.Len(); n != 0 {
+		t.Errorf("Len() after the idle timeout = %d, want 0", n)
+	}
+}
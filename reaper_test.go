@@ -0,0 +1,89 @@
+package callcache_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestWithIdleTimeout(t *testing.T) {
+	for _, n := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency=%d", n), func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0,
+				callcache.WithIdleTimeout(50*time.Millisecond),
+				callcache.WithReaperConcurrency(n),
+			)
+			defer dispatcher.Close()
+
+			fn := func() (interface{}, error) {
+				return "value", nil
+			}
+			for i := 0; i < 100; i++ {
+				dispatcher.Do(fmt.Sprintf("idle%d", i), fn)
+			}
+			for i := 0; i < 20; i++ {
+				dispatcher.Do("busy", fn)
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if keys := dispatcher.Keys(); len(keys) != 1 || keys[0] != "busy" {
+				t.Errorf("Keys() = %v, want [busy]", keys)
+			}
+		})
+	}
+}
+
+func TestWithIdleTimeout_tiny(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithIdleTimeout(1*time.Nanosecond))
+	defer dispatcher.Close()
+
+	dispatcher.Set("key", "value")
+	for i := 0; i < 100 && dispatcher.Len() != 0; i++ {
+		time.Sleep(1 * time.Millisecond)
+	}
+	if n := dispatcher.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+}
+
+func TestDispatcher_RemoveExpired(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithAllowStale(true))
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+	for _, key := range []string{"fresh", "expired1", "expired2"} {
+		dispatcher.Do(key, fn)
+	}
+	dispatcher.Expire("expired1")
+	dispatcher.Expire("expired2")
+
+	if n := dispatcher.RemoveExpired(); n != 2 {
+		t.Errorf("RemoveExpired() = %d, want 2", n)
+	}
+	if keys := dispatcher.Keys(); len(keys) != 1 || keys[0] != "fresh" {
+		t.Errorf("Keys() = %v, want [fresh]", keys)
+	}
+
+	dispatcher.Bump()
+	if n := dispatcher.RemoveExpired(); n != 1 {
+		t.Errorf("RemoveExpired() after Bump() = %d, want 1", n)
+	}
+	if n := dispatcher.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+}
+
+func TestWithExpiredReaping(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(10*time.Millisecond, 0, callcache.WithExpiredReaping(5*time.Millisecond))
+	defer dispatcher.Close()
+
+	dispatcher.Set("key", "value")
+	for i := 0; i < 100 && dispatcher.Len() != 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := dispatcher.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+}
@@ -0,0 +1,28 @@
+package callcache
+
+import "sync"
+
+// resourceGroups holds a mutex for each group for WithResourceGroups, which is
+// never deleted since the set of the groups is expected to be small.
+type resourceGroups struct {
+	group   func(key string) string
+	mu      sync.Mutex
+	lockers map[string]*sync.Mutex
+}
+
+// gate is the function of WithRefreshGate for the groups.
+func (g *resourceGroups) gate(key string) sync.Locker {
+	name := g.group(key)
+	if name == "" {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l, ok := g.lockers[name]
+	if !ok {
+		l = &sync.Mutex{}
+		g.lockers[name] = l
+	}
+	return l
+}
@@ -0,0 +1,32 @@
+package callcache
+
+// ring holds the most recent records up to its capacity.
+type ring[T any] struct {
+	records []T
+	next    int
+	full    bool
+}
+
+func newRing[T any](n int) *ring[T] {
+	return &ring[T]{records: make([]T, n)}
+}
+
+// add adds rec, overwriting the oldest one if the ring is full.
+func (r *ring[T]) add(rec T) {
+	r.records[r.next] = rec
+	r.next++
+	if r.next == len(r.records) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// list returns a copy of the records from the oldest.
+func (r *ring[T]) list() []T {
+	if !r.full {
+		return append([]T(nil), r.records[:r.next]...)
+	}
+	records := make([]T, 0, len(r.records))
+	records = append(records, r.records[r.next:]...)
+	return append(records, r.records[:r.next]...)
+}
@@ -0,0 +1,85 @@
+package callcache
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// scheduler runs the refreshes in the background with a limited number of
+// goroutines. The queued refreshes run in the order of the expiration of their
+// results, so that a key close to expiring is refreshed first instead of
+// waiting behind the others until a caller has to wait for it.
+type scheduler struct {
+	mu      sync.Mutex
+	queue   refreshQueue
+	queued  map[*call]bool
+	running int
+	max     int
+}
+
+func newScheduler(max int) *scheduler {
+	return &scheduler{queued: make(map[*call]bool), max: max}
+}
+
+// submit queues the refresh of c with w unless it is already queued, and
+// starts a goroutine to run it if the limit allows.
+func (s *scheduler) submit(c *call, w work) {
+	c.mu.RLock()
+	deadline := c.lastUpdate.Add(time.Duration(c.ttl()))
+	c.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queued[c] {
+		return
+	}
+	s.queued[c] = true
+	heap.Push(&s.queue, queuedRefresh{c: c, w: w, deadline: deadline})
+	if s.running < s.max {
+		s.running++
+		go s.run()
+	}
+}
+
+// run runs the queued refreshes until the queue is empty.
+func (s *scheduler) run() {
+	for {
+		s.mu.Lock()
+		if s.queue.Len() == 0 {
+			s.running--
+			s.mu.Unlock()
+			return
+		}
+		r := heap.Pop(&s.queue).(queuedRefresh)
+		delete(s.queued, r.c)
+		s.mu.Unlock()
+
+		r.c.backgroundUpdate(r.w)
+	}
+}
+
+type queuedRefresh struct {
+	c        *call
+	w        work
+	deadline time.Time
+}
+
+// refreshQueue is a heap of the queued refreshes ordered by their deadlines.
+type refreshQueue []queuedRefresh
+
+func (q refreshQueue) Len() int           { return len(q) }
+func (q refreshQueue) Less(i, j int) bool { return q[i].deadline.Before(q[j].deadline) }
+func (q refreshQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *refreshQueue) Push(x interface{}) {
+	*q = append(*q, x.(queuedRefresh))
+}
+
+func (q *refreshQueue) Pop() interface{} {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = queuedRefresh{}
+	*q = old[:len(old)-1]
+	return r
+}
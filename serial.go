@@ -0,0 +1,43 @@
+package callcache
+
+import "errors"
+
+// ErrClosed is returned by the calls to the Dispatcher after it is closed,
+// including the ones that would return a cached result.
+var ErrClosed = errors.New("callcache: dispatcher is closed")
+
+// serialJob is a work submitted to the serial executor.
+type serialJob struct {
+	w    work
+	done chan outcome
+}
+
+// invoke calls the function of w, on the serial executor if any.
+func (d *Dispatcher) invoke(w work) (interface{}, error) {
+	if d.serial == nil {
+		return w.call()
+	}
+
+	job := serialJob{w: w, done: make(chan outcome, 1)}
+	select {
+	case d.serial <- job:
+	case <-d.done:
+		return nil, ErrClosed
+	}
+	r := <-job.done
+	return r.v, r.err
+}
+
+// runSerial executes the submitted works one by one until the Dispatcher is
+// closed.
+func (d *Dispatcher) runSerial() {
+	for {
+		select {
+		case <-d.done:
+			return
+		case job := <-d.serial:
+			v, err := job.w.call()
+			job.done <- outcome{v: v, err: err}
+		}
+	}
+}
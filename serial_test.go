@@ -0,0 +1,59 @@
+package callcache_test
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+// goroutineID returns the ID of the current goroutine from its stack trace.
+func goroutineID() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	return string(bytes.Fields(buf)[1])
+}
+
+func TestWithSerialExecutor(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithSerialExecutor())
+
+	var mu sync.Mutex
+	ids := make(map[string]bool)
+	running := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dispatcher.Do(strconv.Itoa(i%5), func() (interface{}, error) {
+				mu.Lock()
+				ids[goroutineID()] = true
+				running++
+				if running > 1 {
+					t.Error("fn ran concurrently")
+				}
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return i, nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	if len(ids) != 1 {
+		t.Errorf("fn ran on %d goroutines, want 1", len(ids))
+	}
+
+	dispatcher.Close()
+	if v, err := dispatcher.Do("closed", func() (interface{}, error) { return "value", nil }); v != nil || err != callcache.ErrClosed {
+		t.Errorf("Do() after Close() = %v, %v, want nil, %v", v, err, callcache.ErrClosed)
+	}
+}
@@ -0,0 +1,208 @@
+package callcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shardCount is the number of shards of the calls in a Dispatcher. The calls
+// are split into shards so that each lock is held only for a part of them,
+// even while all of them are being scanned.
+const shardCount = 32
+
+type shard struct {
+	mu    sync.RWMutex
+	calls map[string]*call
+	// tombstones holds the keys removed with WithRemoveTombstone until when
+	// their results are not cached.
+	tombstones map[string]time.Time
+	// lastRuns holds when fn of the keys was last executed for
+	// WithMinRefreshInterval, which survives the removals of the keys.
+	// They are pruned when the map grows beyond pruneAt.
+	lastRuns map[string]time.Time
+	pruneAt  int
+}
+
+func newShards() []*shard {
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{
+			calls:      make(map[string]*call),
+			tombstones: make(map[string]time.Time),
+			lastRuns:   make(map[string]time.Time),
+		}
+	}
+	return shards
+}
+
+// shard returns the shard of the given key.
+func (d *Dispatcher) shard(key string) *shard {
+	return d.shards[d.shardHasher(key)%shardCount]
+}
+
+// FNVShardHasher is the default hash function to split the keys into the
+// internal shards, which is 64-bit FNV-1a. See WithShardHasher.
+func FNVShardHasher(key string) uint64 {
+	return fnv64a(key)
+}
+
+// fnv64a returns the 64-bit FNV-1a hash of key without allocating.
+func fnv64a(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// rangeCalls calls fn for each call while holding the read lock of its shard.
+func (d *Dispatcher) rangeCalls(fn func(key string, c *call)) {
+	for _, s := range d.shards {
+		s.mu.RLock()
+		for key, c := range s.calls {
+			fn(key, c)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// removeCalls removes the calls for which fn returns true for reason and
+// returns the number of them.
+func (d *Dispatcher) removeCalls(reason EvictReason, fn func(key string, c *call) bool) int {
+	var n int
+	for _, s := range d.shards {
+		n += d.removeShardCalls(s, reason, fn)
+	}
+	return n
+}
+
+// removeShardCalls removes the calls in s for which fn returns true for reason
+// and returns the number of them.
+func (d *Dispatcher) removeShardCalls(s *shard, reason EvictReason, fn func(key string, c *call) bool) int {
+	var removed []*call
+	s.mu.Lock()
+	for key, c := range s.calls {
+		if fn(key, c) {
+			delete(s.calls, key)
+			removed = append(removed, c)
+		}
+	}
+	s.mu.Unlock()
+
+	d.removed(reason, removed...)
+	return len(removed)
+}
+
+// tombstone marks the key removed at now with WithRemoveTombstone, and drops
+// the expired tombstones of the shard. s.mu must be held.
+func (d *Dispatcher) tombstone(s *shard, key string, now time.Time) {
+	for k, until := range s.tombstones {
+		if !now.Before(until) {
+			delete(s.tombstones, k)
+		}
+	}
+	s.tombstones[key] = now.Add(time.Duration(d.tombstoneGrace))
+}
+
+// tombstoned reports whether the results of the key must not be cached at now
+// because it has been removed within the grace period of WithRemoveTombstone.
+func (d *Dispatcher) tombstoned(key string, now time.Time) bool {
+	if d.tombstoneGrace <= 0 {
+		return false
+	}
+	s := d.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	until, ok := s.tombstones[key]
+	return ok && now.Before(until)
+}
+
+// allowRun reports whether fn of the key may be executed at now according to
+// WithMinRefreshInterval, and records the execution if so.
+func (d *Dispatcher) allowRun(key string, now time.Time) bool {
+	interval := time.Duration(d.minRefreshInterval)
+	s := d.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.lastRuns[key]; ok && now.Sub(last) < interval {
+		return false
+	}
+	s.lastRuns[key] = now
+	if len(s.lastRuns) > s.pruneAt {
+		for k, last := range s.lastRuns {
+			if now.Sub(last) >= interval {
+				delete(s.lastRuns, k)
+			}
+		}
+		s.pruneAt = 2*len(s.lastRuns) + 64
+	}
+	return true
+}
+
+// admit adds c to the evictor and evicts the calls over WithMaxEntries.
+func (d *Dispatcher) admit(c *call) {
+	for _, victim := range d.evictor.add(c) {
+		d.evict(victim, EvictCapacity)
+	}
+}
+
+// evict removes the victim chosen by the evictor for reason, which is spilled
+// to the Store of WithOverflowStore if any.
+func (d *Dispatcher) evict(victim *call, reason EvictReason) {
+	if d.removeCall(victim, reason) && d.overflow != nil {
+		d.spill(victim)
+	}
+}
+
+// removeCall removes c for reason unless it has already been replaced with
+// another call. An explicit removal tombstones the key as Remove does.
+func (d *Dispatcher) removeCall(c *call, reason EvictReason) bool {
+	s := d.shard(c.key)
+
+	s.mu.Lock()
+	ok := s.calls[c.key] == c
+	if ok {
+		delete(s.calls, c.key)
+		if reason == EvictRemoved && d.tombstoneGrace > 0 {
+			d.tombstone(s, c.key, d.clock.Now())
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		d.removed(reason, c)
+	}
+	return ok
+}
+
+// removed is called with the calls after they are removed from the shards for
+// reason.
+func (d *Dispatcher) removed(reason EvictReason, calls ...*call) {
+	atomic.AddInt64(&d.stats.removals, int64(len(calls)))
+	atomic.AddInt64(&d.entries, -int64(len(calls)))
+	for _, c := range calls {
+		d.emit(EventEvict, c.key)
+		d.tags.remove(c)
+	}
+	if d.overflow != nil && reason != EvictCapacity && reason != EvictMemory {
+		for _, c := range calls {
+			_ = d.overflow.Delete(c.key)
+		}
+	}
+	if d.onEvict != nil {
+		for _, c := range calls {
+			c.mu.RLock()
+			v, _ := c.value()
+			c.mu.RUnlock()
+			d.onEvict(c.key, v, reason)
+		}
+	}
+	if d.evictor == nil {
+		return
+	}
+	for _, c := range calls {
+		d.evictor.remove(c)
+	}
+}
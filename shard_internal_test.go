@@ -0,0 +1,46 @@
+package callcache
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithShardHasher(t *testing.T) {
+	// The low bits of FNV-1a only depend on the low bits of each byte, so the
+	// keys differing only in the case of the letters fall into the same shard.
+	var keys []string
+	for i := 0; i < 256; i++ {
+		var b strings.Builder
+		for j, r := range "abcdefgh" {
+			if i&(1<<j) != 0 {
+				r -= 'a' - 'A'
+			}
+			b.WriteRune(r)
+		}
+		keys = append(keys, b.String())
+	}
+
+	// largest returns the number of the keys in the largest shard.
+	largest := func(opts ...Option) int {
+		d := NewDispatcher(1*time.Minute, 0, opts...)
+		for _, key := range keys {
+			d.Do(key, func() (interface{}, error) { return "v", nil })
+		}
+		n := 0
+		for _, s := range d.shards {
+			if len(s.calls) > n {
+				n = len(s.calls)
+			}
+		}
+		return n
+	}
+
+	if n := largest(); n != len(keys) {
+		t.Errorf("largest shard with the default hasher has %d keys, want %d", n, len(keys))
+	}
+	// Evenly distributed, each shard has 8 keys on average.
+	if n := largest(WithShardHasher(ringHash)); n > 16 {
+		t.Errorf("largest shard with a custom hasher has %d keys, want at most 16", n)
+	}
+}
@@ -0,0 +1,121 @@
+package callcache
+
+import (
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is the number of points on the hash ring of each Dispatcher in
+// a ShardedDispatcher, which evens out the distribution of the keys.
+const virtualNodes = 128
+
+// ShardedDispatcher routes the keys to multiple Dispatchers by consistent
+// hashing, so that adding or removing a Dispatcher moves only a part of the
+// keys to the others.
+type ShardedDispatcher struct {
+	dispatchers []*Dispatcher
+	ring        []ringPoint
+}
+
+type ringPoint struct {
+	hash       uint64
+	dispatcher *Dispatcher
+}
+
+// NewShardedDispatcher creates a new ShardedDispatcher of the given
+// Dispatchers keyed by their names. The points of each Dispatcher on the hash
+// ring depend only on its name, so a Dispatcher should keep its name when the
+// others are added or removed.
+func NewShardedDispatcher(dispatchers map[string]*Dispatcher) *ShardedDispatcher {
+	names := make([]string, 0, len(dispatchers))
+	for name := range dispatchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s := &ShardedDispatcher{ring: make([]ringPoint, 0, len(dispatchers)*virtualNodes)}
+	for _, name := range names {
+		d := dispatchers[name]
+		s.dispatchers = append(s.dispatchers, d)
+		for j := 0; j < virtualNodes; j++ {
+			s.ring = append(s.ring, ringPoint{
+				hash:       ringHash(name + "-" + strconv.Itoa(j)),
+				dispatcher: d,
+			})
+		}
+	}
+	// Ties are broken by the names, so that the ring does not depend on the
+	// order of the map.
+	sort.SliceStable(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+	return s
+}
+
+// Shard returns the Dispatcher of the given key.
+func (s *ShardedDispatcher) Shard(key string) *Dispatcher {
+	h := ringHash(key)
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].dispatcher
+}
+
+// ringHash returns the position of key on the hash ring. FNV-1a is finalized
+// with the mixer of SplitMix64, since the upper bits of FNV-1a hardly differ
+// among short keys such as numbers.
+func ringHash(key string) uint64 {
+	h := fnv64a(key)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// Do calls Do of the Dispatcher of the given key.
+func (s *ShardedDispatcher) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return s.Shard(key).Do(key, fn)
+}
+
+// Remove calls Remove of the Dispatcher of the given key.
+func (s *ShardedDispatcher) Remove(key string) {
+	s.Shard(key).Remove(key)
+}
+
+// Stats returns the sum of the Stats of the Dispatchers. SnapshotTime is the
+// latest one among them.
+func (s *ShardedDispatcher) Stats() Stats {
+	var total Stats
+	for _, d := range s.dispatchers {
+		st := d.Stats()
+		total.Hits += st.Hits
+		total.Misses += st.Misses
+		total.Executions += st.Executions
+		total.Errors += st.Errors
+		total.Refreshes += st.Refreshes
+		total.Removals += st.Removals
+		total.Leaders += st.Leaders
+		total.Followers += st.Followers
+		if st.SnapshotTime.After(total.SnapshotTime) {
+			total.SnapshotTime = st.SnapshotTime
+		}
+	}
+	return total
+}
+
+// Len returns the total number of keys in the Dispatchers.
+func (s *ShardedDispatcher) Len() int {
+	var n int
+	for _, d := range s.dispatchers {
+		n += d.Len()
+	}
+	return n
+}
+
+// Clear removes all the execution results of the Dispatchers.
+func (s *ShardedDispatcher) Clear() {
+	for _, d := range s.dispatchers {
+		d.Clear()
+	}
+}
@@ -0,0 +1,116 @@
+package callcache_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func newDispatchers(n int) map[string]*callcache.Dispatcher {
+	dispatchers := make(map[string]*callcache.Dispatcher, n)
+	for i := 0; i < n; i++ {
+		dispatchers["shard"+strconv.Itoa(i)] = callcache.NewDispatcher(1*time.Minute, 0)
+	}
+	return dispatchers
+}
+
+// without returns dispatchers without the one of the given name.
+func without(dispatchers map[string]*callcache.Dispatcher, name string) map[string]*callcache.Dispatcher {
+	m := make(map[string]*callcache.Dispatcher, len(dispatchers))
+	for k, d := range dispatchers {
+		if k != name {
+			m[k] = d
+		}
+	}
+	return m
+}
+
+func TestShardedDispatcher(t *testing.T) {
+	const keys = 10000
+	dispatchers := newDispatchers(5)
+	sharded := callcache.NewShardedDispatcher(without(dispatchers, "shard4"))
+	fn := func() (interface{}, error) { return "value", nil }
+
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		sharded.Do(key, fn)
+		if d := sharded.Shard(key); d != sharded.Shard(key) {
+			t.Fatalf("Shard(%s) is not stable", key)
+		}
+	}
+	for name, d := range without(dispatchers, "shard4") {
+		if n := d.Len(); n < keys/4*2/3 || n > keys/4*4/3 {
+			t.Errorf("%s has %d keys, want about %d", name, n, keys/4)
+		}
+	}
+	if n := sharded.Len(); n != keys {
+		t.Errorf("Len() = %d, want %d", n, keys)
+	}
+	if s := sharded.Stats(); s.Misses != keys || s.Executions != keys || s.Leaders != keys {
+		t.Errorf("Stats() = %+v, want %d misses, executions and leaders", s, keys)
+	}
+
+	// Adding a Dispatcher moves only the keys to it.
+	grown := callcache.NewShardedDispatcher(dispatchers)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		if before, after := sharded.Shard(key), grown.Shard(key); before != after {
+			if after != dispatchers["shard4"] {
+				t.Fatalf("key %s moved between existing Dispatchers", key)
+			}
+			moved++
+		}
+	}
+	if moved > keys/5*4/3 {
+		t.Errorf("%d keys moved, want about %d", moved, keys/5)
+	}
+
+	// Removing a Dispatcher in the middle moves only the keys from it.
+	shrunk := callcache.NewShardedDispatcher(without(dispatchers, "shard1"))
+	moved = 0
+	for i := 0; i < keys; i++ {
+		key := strconv.Itoa(i)
+		if before, after := grown.Shard(key), shrunk.Shard(key); before != after {
+			if before != dispatchers["shard1"] {
+				t.Fatalf("key %s moved between the remaining Dispatchers", key)
+			}
+			moved++
+		}
+	}
+	if moved > keys/5*4/3 {
+		t.Errorf("%d keys moved, want about %d", moved, keys/5)
+	}
+
+	sharded.Clear()
+	if n := sharded.Len(); n != 0 {
+		t.Errorf("Len() after Clear() = %d, want 0", n)
+	}
+}
+
+func TestShardedDispatcher_Stats(t *testing.T) {
+	sharded := callcache.NewShardedDispatcher(newDispatchers(3))
+	release := make(chan struct{})
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			sharded.Do("key", func() (interface{}, error) {
+				<-release
+				return "value", nil
+			})
+			done <- struct{}{}
+		}()
+	}
+	for sharded.Shard("key").Waiters("key") != 2 {
+		time.Sleep(1 * time.Millisecond)
+	}
+	close(release)
+	<-done
+	<-done
+
+	if s := sharded.Stats(); s.Leaders != 1 || s.Followers != 1 {
+		t.Errorf("Stats() = %d leaders and %d followers, want 1 and 1", s.Leaders, s.Followers)
+	}
+}
@@ -0,0 +1,84 @@
+package callcache
+
+import "time"
+
+// SnapshotEntry is a cached result in a snapshot.
+type SnapshotEntry struct {
+	Value      interface{}
+	LastUpdate time.Time
+}
+
+// Snapshot returns a copy of the cached results keyed by their keys at a single
+// point in time. Unlike the other methods reading all the keys, it never mixes
+// the results before and after a concurrent update or removal, but it blocks
+// them until the copy is made. It allocates a map of all the entries, whereas
+// the values themselves are not deep copied.
+func (d *Dispatcher) Snapshot() map[string]SnapshotEntry {
+	var entries map[string]SnapshotEntry
+	d.freeze(func(calls []*call) {
+		entries = make(map[string]SnapshotEntry, len(calls))
+		for _, c := range calls {
+			if v, ok := c.value(); ok {
+				entries[c.key] = SnapshotEntry{Value: v, LastUpdate: c.lastUpdate}
+			}
+		}
+	})
+	return entries
+}
+
+// freeze calls fn with all the calls while holding the read locks of all the
+// shards and the calls, so that fn sees them at a single point in time.
+func (d *Dispatcher) freeze(fn func(calls []*call)) {
+	// Freezes are serialized since they hold multiple locks of the calls in
+	// no particular order.
+	d.snapshotMu.Lock()
+	defer d.snapshotMu.Unlock()
+
+	// The locks of all the shards are acquired before any lock of the calls,
+	// which are acquired only once the calls can no longer change.
+	for _, s := range d.shards {
+		s.mu.RLock()
+	}
+	var calls []*call
+	for _, s := range d.shards {
+		for _, c := range s.calls {
+			c.mu.RLock()
+			calls = append(calls, c)
+		}
+	}
+
+	fn(calls)
+
+	for _, c := range calls {
+		c.mu.RUnlock()
+	}
+	for _, s := range d.shards {
+		s.mu.RUnlock()
+	}
+}
+
+// Merge copies the cached results of src into d along with the time they were
+// updated, so that they keep their freshness, and returns the number of them.
+// The keys already having a result in d are skipped unless overwrite is true.
+// It is useful to warm up d that replaces src with another configuration. The
+// keys are copied as they are stored, so both should be created with the same
+// WithKeyHasher if any.
+func (d *Dispatcher) Merge(src *Dispatcher, overwrite bool) int {
+	n := 0
+	for key, e := range src.Snapshot() {
+		c := d.hashedCall(key)
+		c.mu.Lock()
+		if c.loaded && !overwrite {
+			c.mu.Unlock()
+			continue
+		}
+		first := c.store(e.Value, e.LastUpdate)
+		c.mu.Unlock()
+		c.accessed(d.clock.Now())
+		if first {
+			c.firstLoaded(e.Value)
+		}
+		n++
+	}
+	return n
+}
@@ -0,0 +1,103 @@
+package callcache_test
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_Snapshot(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	dispatcher.Set("a", 0)
+	dispatcher.Set("b", 0)
+
+	// The writer always sets a before b, so a coherent view never has b ahead
+	// of a, nor a more than one ahead of b.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			dispatcher.Set("a", i)
+			dispatcher.Set("b", i)
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		entries := dispatcher.Snapshot()
+		a, b := entries["a"].Value.(int), entries["b"].Value.(int)
+		if a != b && a != b+1 {
+			t.Fatalf("Snapshot() has a = %d and b = %d", a, b)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if n := len(dispatcher.Snapshot()); n != 2 {
+		t.Errorf("len(Snapshot()) = %d, want 2", n)
+	}
+}
+
+func TestDispatcher_Merge(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	old := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+	old.Set("shared", "old")
+	old.Set("disjoint", "old")
+	oldAt := clock.Now()
+	clock.Add(10 * time.Second)
+
+	tests := []struct {
+		name      string
+		overwrite bool
+		wantN     int
+		want      string
+		wantAt    time.Time
+	}{
+		{name: "skip", overwrite: false, wantN: 1, want: "new", wantAt: clock.Now()},
+		{name: "overwrite", overwrite: true, wantN: 2, want: "old", wantAt: oldAt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+			dispatcher.Set("shared", "new")
+			dispatcher.Set("own", "new")
+
+			if n := dispatcher.Merge(old, tt.overwrite); n != tt.wantN {
+				t.Errorf("Merge() = %d, want %d", n, tt.wantN)
+			}
+			keys := dispatcher.Keys()
+			sort.Strings(keys)
+			if fmt.Sprint(keys) != "[disjoint own shared]" {
+				t.Errorf("Keys() = %v, want [disjoint own shared]", keys)
+			}
+
+			entries := dispatcher.Snapshot()
+			if e := entries["disjoint"]; e.Value != "old" || !e.LastUpdate.Equal(oldAt) {
+				t.Errorf("disjoint = %+v, want old at %v", e, oldAt)
+			}
+			if e := entries["shared"]; e.Value != tt.want || !e.LastUpdate.Equal(tt.wantAt) {
+				t.Errorf("shared = %+v, want %s at %v", e, tt.want, tt.wantAt)
+			}
+
+			// The merged results expire by the time they were updated.
+			clock.Add(50*time.Second + 1)
+			defer clock.Add(-50*time.Second - 1)
+			if _, ok := dispatcher.Peek("disjoint"); ok {
+				t.Error("Peek(disjoint) after its expiration = true, want false")
+			}
+			if _, ok := dispatcher.Peek("own"); !ok {
+				t.Error("Peek(own) = false, want true")
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package callcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the cumulative counters of a Dispatcher. The counters
+// only increase until ResetStats is called, so the rates can be computed from
+// the differences between two snapshots and their SnapshotTime.
+type Stats struct {
+	// Hits is the number of calls that got a valid execution result.
+	Hits int64
+	// Misses is the number of calls that had to wait for an execution.
+	Misses int64
+	// Executions is the number of executions of fn, including the ones in the
+	// background.
+	Executions int64
+	// Errors is the number of executions of fn that returned an error.
+	Errors int64
+	// Refreshes is the number of updates launched in the background.
+	Refreshes int64
+	// Removals is the number of keys removed from the Dispatcher.
+	Removals int64
+	// Leaders is the number of calls waiting for an execution that executed
+	// fn, and Followers is the number of them that shared the result of
+	// another. See FlightStats.
+	Leaders   int64
+	Followers int64
+	// SnapshotTime is when the snapshot was taken.
+	SnapshotTime time.Time
+}
+
+// stats holds the counters of Stats, and the ones of each key for PerKeyStats
+// and FlightStats. All fields are accessed atomically.
+type stats struct {
+	hits       int64
+	misses     int64
+	executions int64
+	errors     int64
+	refreshes  int64
+	removals   int64
+	leaders    int64
+	followers  int64
+}
+
+// Stats returns a snapshot of the counters. Each counter is read atomically,
+// but the snapshot as a whole is not taken at a single point in time.
+func (d *Dispatcher) Stats() Stats {
+	return Stats{
+		Hits:         atomic.LoadInt64(&d.stats.hits),
+		Misses:       atomic.LoadInt64(&d.stats.misses),
+		Executions:   atomic.LoadInt64(&d.stats.executions),
+		Errors:       atomic.LoadInt64(&d.stats.errors),
+		Refreshes:    atomic.LoadInt64(&d.stats.refreshes),
+		Removals:     atomic.LoadInt64(&d.stats.removals),
+		Leaders:      atomic.LoadInt64(&d.stats.leaders),
+		Followers:    atomic.LoadInt64(&d.stats.followers),
+		SnapshotTime: d.clock.Now(),
+	}
+}
+
+// ResetStats sets all counters to zero.
+func (d *Dispatcher) ResetStats() {
+	atomic.StoreInt64(&d.stats.hits, 0)
+	atomic.StoreInt64(&d.stats.misses, 0)
+	atomic.StoreInt64(&d.stats.executions, 0)
+	atomic.StoreInt64(&d.stats.errors, 0)
+	atomic.StoreInt64(&d.stats.refreshes, 0)
+	atomic.StoreInt64(&d.stats.removals, 0)
+	atomic.StoreInt64(&d.stats.leaders, 0)
+	atomic.StoreInt64(&d.stats.followers, 0)
+}
+
+// FlightStats returns the number of the calls for the given key that waited for
+// an execution, split into the leaders that executed fn and the followers that
+// shared the result of a leader, which shows how effectively the duplicate
+// executions are suppressed. The updates in the background are not counted,
+// and the counts are not reset by ResetStats.
+func (d *Dispatcher) FlightStats(key string) (leaders, followers int64) {
+	if d.checkKey(key) != nil {
+		return 0, 0
+	}
+	c := d.lookup(key)
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&c.stats.leaders), atomic.LoadInt64(&c.stats.followers)
+}
+
+// KeyStats is a snapshot of the counters of a key, which are counted in the
+// same way as Stats.
+type KeyStats struct {
+	Hits      int64
+	Misses    int64
+	Refreshes int64
+	Errors    int64
+	// LastUpdate is when the execution result was stored, which is zero if
+	// there is none.
+	LastUpdate time.Time
+}
+
+// PerKeyStats returns the KeyStats of all the keys at a single point in time,
+// which blocks the updates and removals until it is taken like Snapshot. Since
+// the map has an entry for each key, it suits a Dispatcher with a small number
+// of keys, such as for the labels of the metrics. The counters are not reset by
+// ResetStats.
+func (d *Dispatcher) PerKeyStats() map[string]KeyStats {
+	var m map[string]KeyStats
+	d.freeze(func(calls []*call) {
+		m = make(map[string]KeyStats, len(calls))
+		for _, c := range calls {
+			m[c.key] = KeyStats{
+				Hits:       atomic.LoadInt64(&c.stats.hits),
+				Misses:     atomic.LoadInt64(&c.stats.misses),
+				Refreshes:  atomic.LoadInt64(&c.stats.refreshes),
+				Errors:     atomic.LoadInt64(&c.stats.errors),
+				LastUpdate: c.lastUpdate,
+			}
+		}
+	})
+	return m
+}
@@ -0,0 +1,131 @@
+package callcache_test
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_Stats(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+	ok := func() (interface{}, error) { return "v", nil }
+	fail := func() (interface{}, error) { return nil, errors.New("failed") }
+
+	// Activity before the first snapshot must not affect the deltas.
+	dispatcher.Do("warm", ok)
+	dispatcher.Do("warm", ok)
+
+	before := dispatcher.Stats()
+	clock.Add(10 * time.Second)
+
+	dispatcher.Do("a", ok)
+	dispatcher.Do("a", ok)
+	dispatcher.Do("a", ok)
+	dispatcher.Do("b", fail)
+	dispatcher.Remove("a")
+	dispatcher.Remove("missing")
+
+	after := dispatcher.Stats()
+	want := callcache.Stats{
+		Hits:         2,
+		Misses:       2,
+		Executions:   2,
+		Errors:       1,
+		Removals:     1,
+		SnapshotTime: clock.Now(),
+	}
+	got := callcache.Stats{
+		Hits:         after.Hits - before.Hits,
+		Misses:       after.Misses - before.Misses,
+		Executions:   after.Executions - before.Executions,
+		Errors:       after.Errors - before.Errors,
+		Refreshes:    after.Refreshes - before.Refreshes,
+		Removals:     after.Removals - before.Removals,
+		SnapshotTime: after.SnapshotTime,
+	}
+	if got != want {
+		t.Errorf("deltas = %+v, want %+v", got, want)
+	}
+	if d := after.SnapshotTime.Sub(before.SnapshotTime); d != 10*time.Second {
+		t.Errorf("SnapshotTime difference = %v, want 10s", d)
+	}
+
+	dispatcher.ResetStats()
+	if s := dispatcher.Stats(); s.Hits != 0 || s.Misses != 0 || s.Executions != 0 || s.Errors != 0 || s.Removals != 0 {
+		t.Errorf("Stats() after ResetStats = %+v, want zero counters", s)
+	}
+}
+
+func TestDispatcher_FlightStats(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		return "v", nil
+	}
+
+	// Each round has a leader and three followers.
+	for round := 0; round < 2; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				dispatcher.Do("key", fn)
+			}()
+		}
+		for dispatcher.Waiters("key") != 4 {
+			time.Sleep(1 * time.Millisecond)
+		}
+		release <- struct{}{}
+		wg.Wait()
+		dispatcher.Expire("key")
+	}
+	dispatcher.Do("other", func() (interface{}, error) { return "v", nil })
+
+	if leaders, followers := dispatcher.FlightStats("key"); leaders != 2 || followers != 6 {
+		t.Errorf("FlightStats(key) = %d, %d, want 2, 6", leaders, followers)
+	}
+	if leaders, followers := dispatcher.FlightStats("missing"); leaders != 0 || followers != 0 {
+		t.Errorf("FlightStats(missing) = %d, %d, want 0, 0", leaders, followers)
+	}
+	if s := dispatcher.Stats(); s.Leaders != 3 || s.Followers != 6 {
+		t.Errorf("Stats() = %d leaders and %d followers, want 3 and 6", s.Leaders, s.Followers)
+	}
+}
+
+func TestDispatcher_PerKeyStats(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	refreshed := make(chan struct{})
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 10*time.Second,
+		callcache.WithClock(clock),
+		callcache.WithRefreshDoneHook(func(string) { refreshed <- struct{}{} }),
+	)
+	ok := func() (interface{}, error) { return "v", nil }
+	fail := func() (interface{}, error) { return nil, errors.New("failed") }
+
+	storedAt := clock.Now()
+	for i := 0; i < 3; i++ {
+		dispatcher.Do("a", ok)
+	}
+	dispatcher.Do("b", fail)
+	dispatcher.Do("b", fail)
+	dispatcher.Do("c", ok)
+	clock.Add(11 * time.Second)
+	dispatcher.Do("c", ok)
+	<-refreshed
+
+	want := map[string]callcache.KeyStats{
+		"a": {Hits: 2, Misses: 1, LastUpdate: storedAt},
+		"b": {Misses: 2, Errors: 2},
+		"c": {Hits: 1, Misses: 1, Refreshes: 1, LastUpdate: clock.Now()},
+	}
+	if got := dispatcher.PerKeyStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PerKeyStats() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,86 @@
+package callcache
+
+import "sync"
+
+// tagIndex maps the tags given to DoTagged to the calls carrying them.
+type tagIndex struct {
+	mu    sync.Mutex
+	calls map[string]map[*call]struct{}
+	tags  map[*call][]string
+}
+
+// add tags c with tags.
+func (x *tagIndex) add(c *call, tags []string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if x.calls == nil {
+		x.calls = make(map[string]map[*call]struct{})
+		x.tags = make(map[*call][]string)
+	}
+	for _, tag := range tags {
+		calls, ok := x.calls[tag]
+		if !ok {
+			calls = make(map[*call]struct{})
+			x.calls[tag] = calls
+		}
+		if _, ok := calls[c]; !ok {
+			calls[c] = struct{}{}
+			x.tags[c] = append(x.tags[c], tag)
+		}
+	}
+}
+
+// remove drops c that has been removed from the Dispatcher.
+func (x *tagIndex) remove(c *call) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, tag := range x.tags[c] {
+		delete(x.calls[tag], c)
+		if len(x.calls[tag]) == 0 {
+			delete(x.calls, tag)
+		}
+	}
+	delete(x.tags, c)
+}
+
+// tagged returns the calls carrying tag.
+func (x *tagIndex) tagged(tag string) []*call {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	calls := make([]*call, 0, len(x.calls[tag]))
+	for c := range x.calls[tag] {
+		calls = append(calls, c)
+	}
+	return calls
+}
+
+// DoTagged is like Do, but associates the given key with tags, so that it is
+// removed by InvalidateTag with any of them. The tags are added to the ones
+// already associated with the key, and they are dropped when it is removed.
+func (d *Dispatcher) DoTagged(key string, tags []string, fn func() (interface{}, error)) (interface{}, error) {
+	if err := d.checkCall(key); err != nil {
+		return nil, err
+	}
+	c := d.call(key)
+	d.tags.add(c, tags)
+	if d.lookup(key) != c {
+		// Removed in the meantime, so nothing would drop the tags.
+		d.tags.remove(c)
+	}
+	return c.do(work{fn: fn})
+}
+
+// InvalidateTag removes the execution results of the keys associated with tag
+// by DoTagged, and returns the number of them.
+func (d *Dispatcher) InvalidateTag(tag string) int {
+	n := 0
+	for _, c := range d.tags.tagged(tag) {
+		if d.removeCall(c, EvictRemoved) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,48 @@
+package callcache_test
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDispatcher_InvalidateTag(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	fn := func() (interface{}, error) {
+		return "value", nil
+	}
+	dispatcher.DoTagged("product:42:detail", []string{"product:42"}, fn)
+	dispatcher.DoTagged("ranking:top", []string{"product:42", "product:7"}, fn)
+	dispatcher.DoTagged("product:7:detail", []string{"product:7"}, fn)
+	dispatcher.Do("untagged", fn)
+
+	if n := dispatcher.InvalidateTag("product:42"); n != 2 {
+		t.Errorf("InvalidateTag(product:42) = %d, want 2", n)
+	}
+	keys := dispatcher.Keys()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "product:7:detail" || keys[1] != "untagged" {
+		t.Errorf("Keys() = %v, want [product:7:detail untagged]", keys)
+	}
+
+	// The tags of the removed keys are dropped, even if they have others.
+	if n := dispatcher.InvalidateTag("product:7"); n != 1 {
+		t.Errorf("InvalidateTag(product:7) = %d, want 1", n)
+	}
+	if n := dispatcher.InvalidateTag("product:42"); n != 0 {
+		t.Errorf("InvalidateTag(product:42) again = %d, want 0", n)
+	}
+
+	// A key stored again after the removal is not tagged unless DoTagged is.
+	dispatcher.DoTagged("product:42:detail", []string{"product:42"}, fn)
+	dispatcher.Remove("product:42:detail")
+	dispatcher.Do("product:42:detail", fn)
+	if n := dispatcher.InvalidateTag("product:42"); n != 0 {
+		t.Errorf("InvalidateTag(product:42) after Remove() = %d, want 0", n)
+	}
+	if n := dispatcher.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+}
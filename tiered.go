@@ -0,0 +1,28 @@
+package callcache
+
+// Tiered is a two-tier cache of Dispatchers, where L1 is typically small and
+// has a shorter expiration than L2.
+type Tiered struct {
+	l1, l2 *Dispatcher
+}
+
+// NewTiered creates a new Tiered of l1 and l2.
+func NewTiered(l1, l2 *Dispatcher) *Tiered {
+	return &Tiered{l1: l1, l2: l2}
+}
+
+// Do returns the execution result associated with the given key from L1, or
+// from L2 if there is no valid one in L1, or of fn if there is neither. The
+// result is cached in both tiers on the way back. Refreshes of L1 are also
+// served from L2, so fn is only executed according to the timing of L2.
+func (t *Tiered) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	return t.l1.Do(key, func() (interface{}, error) {
+		return t.l2.Do(key, fn)
+	})
+}
+
+// Remove removes the execution result of the given key from both tiers.
+func (t *Tiered) Remove(key string) {
+	t.l1.Remove(key)
+	t.l2.Remove(key)
+}
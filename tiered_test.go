@@ -0,0 +1,41 @@
+package callcache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestTiered_Do(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l1 := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithClock(clock))
+	l2 := callcache.NewDispatcher(10*time.Minute, 0, callcache.WithClock(clock))
+	tiered := callcache.NewTiered(l1, l2)
+
+	calls := 0
+	fn := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    int
+	}{
+		{name: "full miss", want: 1},
+		{name: "L1 hit", elapsed: 30 * time.Second, want: 1},
+		{name: "L1 miss and L2 hit", elapsed: 2 * time.Minute, want: 1},
+		{name: "full miss after L2 expired", elapsed: 11 * time.Minute, want: 2},
+	}
+	for _, tt := range tests {
+		clock.Add(tt.elapsed)
+		if v, err := tiered.Do("key", fn); v != tt.want || err != nil {
+			t.Errorf("%s: Do() = %v, %v, want %v, nil", tt.name, v, err, tt.want)
+		}
+		if v1, v2 := l1.Snapshot()["key"].Value, l2.Snapshot()["key"].Value; v1 != tt.want || v2 != tt.want {
+			t.Errorf("%s: cached %v in L1 and %v in L2, want %v in both", tt.name, v1, v2, tt.want)
+		}
+	}
+}
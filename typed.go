@@ -0,0 +1,19 @@
+package callcache
+
+// pair is the execution result of Do2.
+type pair[A, B any] struct {
+	a A
+	b B
+}
+
+// Do2 is like Do, but for fn returning two values, which are cached together.
+// They are boxed into an interface{} at each execution of fn, which allocates
+// unless both of them are small, but a cache hit does not allocate.
+func Do2[A, B any](d *Dispatcher, key string, fn func() (A, B, error)) (A, B, error) {
+	v, err := d.Do(key, func() (interface{}, error) {
+		a, b, err := fn()
+		return pair[A, B]{a: a, b: b}, err
+	})
+	p, _ := v.(pair[A, B])
+	return p.a, p.b, err
+}
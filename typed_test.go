@@ -0,0 +1,35 @@
+package callcache_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+func TestDo2(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0)
+	calls := 0
+	fn := func() (string, int, error) {
+		calls++
+		return "answer", 42, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if s, n, err := callcache.Do2(dispatcher, "key", fn); s != "answer" || n != 42 || err != nil {
+			t.Errorf("Do2() = %q, %d, %v, want answer, 42, nil", s, n, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fn was called %d times, want 1", calls)
+	}
+
+	errFailed := errors.New("failed")
+	s, n, err := callcache.Do2(dispatcher, "failing", func() (string, int, error) {
+		return "partial", 1, errFailed
+	})
+	if s != "partial" || n != 1 || err != errFailed {
+		t.Errorf("Do2() = %q, %d, %v, want partial, 1, %v", s, n, err, errFailed)
+	}
+}
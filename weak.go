@@ -0,0 +1,36 @@
+//go:build go1.24
+
+package callcache
+
+import (
+	"reflect"
+	"unsafe"
+	"weak"
+)
+
+// weakValue is a result held by a weak pointer along with its type to restore
+// the original value.
+type weakValue struct {
+	typ reflect.Type
+	ptr weak.Pointer[byte]
+}
+
+func makeWeak(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Type().Elem().Size() == 0 {
+		return v
+	}
+	return weakValue{typ: rv.Type(), ptr: weak.Make((*byte)(rv.UnsafePointer()))}
+}
+
+func resolveWeak(v interface{}) (interface{}, bool) {
+	w, ok := v.(weakValue)
+	if !ok {
+		return v, true
+	}
+	p := w.ptr.Value()
+	if p == nil {
+		return nil, false
+	}
+	return reflect.NewAt(w.typ.Elem(), unsafe.Pointer(p)).Interface(), true
+}
@@ -0,0 +1,11 @@
+//go:build !go1.24
+
+package callcache
+
+func makeWeak(v interface{}) interface{} {
+	return v
+}
+
+func resolveWeak(v interface{}) (interface{}, bool) {
+	return v, true
+}
@@ -0,0 +1,38 @@
+//go:build go1.24
+
+package callcache_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/daisuzu/callcache"
+)
+
+type payload struct {
+	data [1024]byte
+}
+
+func TestWithWeakValues(t *testing.T) {
+	dispatcher := callcache.NewDispatcher(1*time.Minute, 0, callcache.WithWeakValues())
+
+	var calls int
+	fn := func() (interface{}, error) {
+		calls++
+		return &payload{}, nil
+	}
+
+	v, _ := dispatcher.Do("key", fn)
+	runtime.GC()
+	if got, _ := dispatcher.Do("key", fn); got != v || calls != 1 {
+		t.Errorf("Do() = %p with %d calls, want %p with 1 call", got, calls, v)
+	}
+
+	v = nil
+	runtime.GC()
+	runtime.GC()
+	if got, _ := dispatcher.Do("key", fn); got == nil || calls != 2 {
+		t.Errorf("Do() = %p with %d calls, want a reloaded value with 2 calls", got, calls)
+	}
+}
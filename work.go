@@ -0,0 +1,137 @@
+package callcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// work is a function to execute for a call. It is passed by value, so that a
+// cache hit does not allocate it.
+type work struct {
+	fn    func() (interface{}, error)
+	ctx   context.Context
+	ctxFn func(ctx context.Context) (interface{}, error)
+
+	// validUntil pins the expiration of the result if it is not zero.
+	validUntil time.Time
+	// async is true if no caller waits for the result.
+	async bool
+	// force executes the function even if the result is fresh, for
+	// ForceRefresh.
+	force bool
+	// at replaces the current time of the clock if it is not zero, for doAt.
+	at time.Time
+	// batched waits for the batch of WithBatchLoader instead of calling the
+	// function.
+	batched bool
+	// fingerprint is given to DoWithFingerprint if hasFingerprint is true.
+	fingerprint    interface{}
+	hasFingerprint bool
+}
+
+// annotated is returned by the function of a work instead of the value to tell
+// execute how to cache the value.
+type annotated struct {
+	v interface{}
+	// token is stored along with v for DoConditional if hasToken is true.
+	token    string
+	hasToken bool
+	// keep caches v even though the function returns an error, for DoPartial.
+	keep bool
+	// transformed is true if v has already been transformed by WithTransform,
+	// such as the current result kept by DoConditional.
+	transformed bool
+}
+
+// unwrap returns the value returned by the function of a work and how to
+// cache it.
+func unwrap(v interface{}) (interface{}, annotated) {
+	if a, ok := v.(annotated); ok {
+		return a.v, a
+	}
+	return v, annotated{v: v}
+}
+
+// now returns the current time for w.
+func (w work) now(clock Clock) time.Time {
+	if !w.at.IsZero() {
+		return w.at
+	}
+	return clock.Now()
+}
+
+func (w work) call() (interface{}, error) {
+	if w.ctxFn != nil {
+		return w.ctxFn(w.ctx)
+	}
+	return w.fn()
+}
+
+// ErrTimeout is returned when fn does not return within the timeout given to
+// DoWithTimeout.
+var ErrTimeout = errors.New("callcache: timed out")
+
+// outcome is the return values of the function of a work.
+type outcome struct {
+	v   interface{}
+	err error
+}
+
+// callTimeout calls w with call in another goroutine and returns ErrTimeout if
+// it does not return within timeout. The context given to the function of w is
+// canceled at that time.
+func (w work) callTimeout(timeout time.Duration, call func(w work) (interface{}, error)) (interface{}, error) {
+	if w.ctxFn != nil {
+		var cancel context.CancelFunc
+		w.ctx, cancel = context.WithTimeout(w.ctx, timeout)
+		defer cancel()
+	}
+
+	ch := make(chan outcome, 1)
+	go func() {
+		v, err := call(w)
+		ch <- outcome{v: v, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.v, r.err
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+// background returns w to be executed in the background, whose context is
+// detached from the caller.
+func (w work) background() work {
+	w.async = true
+	if w.ctx != nil {
+		w.ctx = detachedContext{w.ctx}
+	}
+	return w
+}
+
+// detachedContext is a context that is never canceled but carries the values
+// of the parent.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}